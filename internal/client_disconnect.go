@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// disconnectPollInterval is how often a request checks whether its client is still connected
+const disconnectPollInterval = 100 * time.Millisecond
+
+// errClientDisconnected is the cause of the cancellation when the client closes the connection
+var errClientDisconnected = errors.New("client disconnected")
+
+// withClientDisconnect returns a copy of parent that is canceled when the client on conn closes
+// the connection. fasthttp does not report this on its own, so the connection is polled until
+// the returned cancel function is called.
+func withClientDisconnect(parent context.Context, conn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if conn != nil {
+		go func() {
+			ticker := time.NewTicker(disconnectPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if peerClosed(conn) {
+						cancel(errClientDisconnected)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	return ctx, func() { cancel(context.Canceled) }
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package internal
+
+import "net"
+
+// peerClosed always reports an open connection on platforms where the socket can not be peeked at.
+// Requests there only stop early when they reach the processing deadline.
+func peerClosed(conn net.Conn) bool {
+	return false
+}
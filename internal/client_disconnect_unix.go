@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// peerClosed reports whether the other end of conn has closed it. It peeks at the socket
+// without consuming anything, so the next request on a keep-alive connection is left intact.
+func peerClosed(conn net.Conn) bool {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	closed := false
+	rawConn.Control(func(fd uintptr) {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case err == nil:
+			closed = n == 0
+		case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+			closed = false
+		default:
+			closed = true
+		}
+	})
+	return closed
+}
@@ -4,5 +4,30 @@ const (
 	MIMEImageJpeg = "image/jpeg"
 	MIMEImagePng  = "image/png"
 
+	HeaderImageWidth  = "X-Image-Width"
+	HeaderImageHeight = "X-Image-Height"
+
 	ImageStoreTypeLocal = "disk"
+
+	GravityCenter = "center"
+	GravitySmart  = "smart"
+
+	FlipHorizontal = "h"
+	FlipVertical   = "v"
+
+	FilterLanczos    = "lanczos"
+	FilterCatmullRom = "catmullrom"
+	FilterLinear     = "linear"
+	FilterBox        = "box"
+	FilterNearest    = "nearest"
+
+	WatermarkTopLeft     = "topleft"
+	WatermarkTopRight    = "topright"
+	WatermarkBottomLeft  = "bottomleft"
+	WatermarkBottomRight = "bottomright"
+
+	CaptionTop    = "top"
+	CaptionBottom = "bottom"
+
+	MaskCircle = "circle"
 )
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	exifTagExifIFD          = 0x8769
+	exifTagDateTime         = 0x0132
+	exifTagDateTimeOriginal = 0x9003
+	exifTagThumbnailOffset  = 0x0201
+	exifTagThumbnailLength  = 0x0202
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+)
+
+var errNoExif = errors.New("no exif data")
+
+// exifData holds the handful of EXIF fields the service cares about
+type exifData struct {
+	dateTaken time.Time
+	thumbnail []byte // Embedded JPEG preview, nil when there is none
+}
+
+// readExif parses the EXIF block of a JPEG. It returns errNoExif when the file has none.
+func readExif(r io.Reader) (*exifData, error) {
+	payload, err := jpegExifPayload(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	tiff := exifTiff{data: payload}
+	switch string(payload[:min(2, len(payload))]) {
+	case "II":
+		tiff.order = binary.LittleEndian
+	case "MM":
+		tiff.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid exif byte order")
+	}
+
+	ifd0, err := tiff.uint32(4)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &exifData{}
+	entries, ifd1, err := tiff.ifd(ifd0)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := entries[exifTagDateTime]; ok {
+		data.dateTaken = tiff.time(value)
+	}
+
+	if offset, ok := entries[exifTagExifIFD]; ok {
+		if exifEntries, _, err := tiff.ifd(tiff.order.Uint32(offset.value[:])); err == nil {
+			if value, ok := exifEntries[exifTagDateTimeOriginal]; ok {
+				if taken := tiff.time(value); !taken.IsZero() {
+					data.dateTaken = taken
+				}
+			}
+		}
+	}
+
+	if ifd1 != 0 {
+		if thumbnailEntries, _, err := tiff.ifd(ifd1); err == nil {
+			data.thumbnail = tiff.thumbnail(thumbnailEntries)
+		}
+	}
+
+	return data, nil
+}
+
+// jpegExifPayload walks the JPEG markers up to the image data and returns the TIFF
+// structure stored in the APP1 Exif segment
+func jpegExifPayload(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, errNoExif
+	}
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, errNoExif
+		}
+		if marker[0] != 0xFF {
+			return nil, errNoExif
+		}
+
+		// Start of scan or end of image, there is no EXIF block before the pixel data
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil, errNoExif
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, errNoExif
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+type exifEntry struct {
+	dataType uint16
+	count    uint32
+	value    [4]byte
+}
+
+type exifTiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (t exifTiff) uint16(offset uint32) (uint16, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return 0, fmt.Errorf("exif offset out of range")
+	}
+	return t.order.Uint16(t.data[offset:]), nil
+}
+
+func (t exifTiff) uint32(offset uint32) (uint32, error) {
+	if uint64(offset)+4 > uint64(len(t.data)) {
+		return 0, fmt.Errorf("exif offset out of range")
+	}
+	return t.order.Uint32(t.data[offset:]), nil
+}
+
+// ifd reads the directory at offset and returns its entries by tag along with the offset of the next directory
+func (t exifTiff) ifd(offset uint32) (map[uint16]exifEntry, uint32, error) {
+	count, err := t.uint16(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(map[uint16]exifEntry, count)
+	position := offset + 2
+	for i := 0; i < int(count); i++ {
+		if uint64(position)+12 > uint64(len(t.data)) {
+			return nil, 0, fmt.Errorf("exif directory out of range")
+		}
+		var entry exifEntry
+		tag := t.order.Uint16(t.data[position:])
+		entry.dataType = t.order.Uint16(t.data[position+2:])
+		entry.count = t.order.Uint32(t.data[position+4:])
+		copy(entry.value[:], t.data[position+8:position+12])
+		entries[tag] = entry
+		position += 12
+	}
+
+	next, err := t.uint32(position)
+	if err != nil {
+		next = 0
+	}
+
+	return entries, next, nil
+}
+
+// time decodes an ASCII date entry, returning the zero time when it is missing or malformed
+func (t exifTiff) time(entry exifEntry) time.Time {
+	const typeASCII = 2
+	if entry.dataType != typeASCII || entry.count < uint32(len(exifTimeLayout)) {
+		return time.Time{}
+	}
+
+	offset := t.order.Uint32(entry.value[:])
+	if uint64(offset)+uint64(len(exifTimeLayout)) > uint64(len(t.data)) {
+		return time.Time{}
+	}
+
+	value, err := time.ParseInLocation(exifTimeLayout, string(t.data[offset:offset+uint32(len(exifTimeLayout))]), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return value
+}
+
+// thumbnail returns the embedded JPEG described by the IFD1 entries, or nil if it is missing or out of range
+func (t exifTiff) thumbnail(entries map[uint16]exifEntry) []byte {
+	offsetEntry, hasOffset := entries[exifTagThumbnailOffset]
+	lengthEntry, hasLength := entries[exifTagThumbnailLength]
+	if !hasOffset || !hasLength {
+		return nil
+	}
+
+	offset := uint64(t.order.Uint32(offsetEntry.value[:]))
+	length := uint64(t.order.Uint32(lengthEntry.value[:]))
+	if length == 0 || offset+length > uint64(len(t.data)) {
+		return nil
+	}
+
+	return t.data[offset : offset+length]
+}
@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Offsets of the fields in the TIFF structure built by buildExifTiff
+const (
+	testIfd0Offset          = 8
+	testExifIfdOffset       = 38
+	testIfd1Offset          = 56
+	testDateTimeOffset      = 86
+	testDateTimeOrigOffset  = 106
+	testThumbnailDataOffset = 126
+)
+
+var testThumbnail = []byte{0xFF, 0xD8, 0x01, 0x02, 0x03, 0xFF, 0xD9}
+
+// buildExifTiff returns a TIFF structure with DateTime in IFD0, DateTimeOriginal in the Exif IFD
+// and a thumbnail in IFD1
+func buildExifTiff(order binary.ByteOrder) []byte {
+	data := make([]byte, testThumbnailDataOffset+len(testThumbnail))
+	if order == binary.ByteOrder(binary.LittleEndian) {
+		copy(data, "II")
+	} else {
+		copy(data, "MM")
+	}
+	order.PutUint16(data[2:], 42)
+	order.PutUint32(data[4:], testIfd0Offset)
+
+	entry := func(position int, tag, dataType uint16, count, value uint32) {
+		order.PutUint16(data[position:], tag)
+		order.PutUint16(data[position+2:], dataType)
+		order.PutUint32(data[position+4:], count)
+		order.PutUint32(data[position+8:], value)
+	}
+
+	order.PutUint16(data[testIfd0Offset:], 2)
+	entry(testIfd0Offset+2, exifTagDateTime, 2, 20, testDateTimeOffset)
+	entry(testIfd0Offset+14, exifTagExifIFD, 4, 1, testExifIfdOffset)
+	order.PutUint32(data[testIfd0Offset+26:], testIfd1Offset)
+
+	order.PutUint16(data[testExifIfdOffset:], 1)
+	entry(testExifIfdOffset+2, exifTagDateTimeOriginal, 2, 20, testDateTimeOrigOffset)
+	order.PutUint32(data[testExifIfdOffset+14:], 0)
+
+	order.PutUint16(data[testIfd1Offset:], 2)
+	entry(testIfd1Offset+2, exifTagThumbnailOffset, 4, 1, testThumbnailDataOffset)
+	entry(testIfd1Offset+14, exifTagThumbnailLength, 4, 1, uint32(len(testThumbnail)))
+	order.PutUint32(data[testIfd1Offset+26:], 0)
+
+	copy(data[testDateTimeOffset:], "2020:01:02 03:04:05\x00")
+	copy(data[testDateTimeOrigOffset:], "2019:06:07 08:09:10\x00")
+	copy(data[testThumbnailDataOffset:], testThumbnail)
+
+	return data
+}
+
+// exifJpeg wraps tiff in the APP1 segment of a JPEG that ends right after it
+func exifJpeg(tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	if len(segment) > 0xFFFF-2 {
+		segment = segment[:0xFFFF-2]
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&buf, binary.BigEndian, uint16(len(segment)+2))
+	buf.Write(segment)
+	buf.Write([]byte{0xFF, 0xD9})
+	return buf.Bytes()
+}
+
+func TestReadExif(t *testing.T) {
+	dateTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	dateTimeOriginal := time.Date(2019, 6, 7, 8, 9, 10, 0, time.Local)
+
+	modified := func(order binary.ByteOrder, modify func(data []byte)) []byte {
+		data := buildExifTiff(order)
+		modify(data)
+		return data
+	}
+
+	tests := []struct {
+		name          string
+		tiff          []byte
+		wantErr       bool
+		wantDate      time.Time
+		wantThumbnail bool
+	}{
+		{
+			name:          "little endian",
+			tiff:          buildExifTiff(binary.LittleEndian),
+			wantDate:      dateTimeOriginal,
+			wantThumbnail: true,
+		},
+		{
+			name:          "big endian",
+			tiff:          buildExifTiff(binary.BigEndian),
+			wantDate:      dateTimeOriginal,
+			wantThumbnail: true,
+		},
+		{
+			name:    "invalid byte order",
+			tiff:    modified(binary.LittleEndian, func(data []byte) { copy(data, "XX") }),
+			wantErr: true,
+		},
+		{
+			name:    "empty payload",
+			tiff:    []byte{},
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			tiff:    buildExifTiff(binary.LittleEndian)[:6],
+			wantErr: true,
+		},
+		{
+			name:    "truncated IFD0",
+			tiff:    buildExifTiff(binary.BigEndian)[:testIfd0Offset+20],
+			wantErr: true,
+		},
+		{
+			name: "IFD0 offset out of range",
+			tiff: modified(binary.LittleEndian, func(data []byte) {
+				binary.LittleEndian.PutUint32(data[4:], 0xFFFFFFF0)
+			}),
+			wantErr: true,
+		},
+		{
+			name: "entry count past the end",
+			tiff: modified(binary.BigEndian, func(data []byte) {
+				binary.BigEndian.PutUint16(data[testIfd0Offset:], 0xFFFF)
+			}),
+			wantErr: true,
+		},
+		{
+			name: "exif IFD out of range falls back to DateTime",
+			tiff: modified(binary.LittleEndian, func(data []byte) {
+				binary.LittleEndian.PutUint32(data[testIfd0Offset+14+8:], 0xFFFFFFFF)
+			}),
+			wantDate:      dateTime,
+			wantThumbnail: true,
+		},
+		{
+			name: "date offset out of range",
+			tiff: modified(binary.BigEndian, func(data []byte) {
+				binary.BigEndian.PutUint32(data[testIfd0Offset+2+8:], 0xFFFFFFF0)
+				binary.BigEndian.PutUint32(data[testExifIfdOffset+2+8:], 0xFFFFFFF0)
+			}),
+			wantThumbnail: true,
+		},
+		{
+			name: "malformed date",
+			tiff: modified(binary.LittleEndian, func(data []byte) {
+				copy(data[testDateTimeOffset:], "not a date at all!!")
+				copy(data[testDateTimeOrigOffset:], "2019-06-07T08:09:10")
+			}),
+			wantThumbnail: true,
+		},
+		{
+			name: "IFD1 out of range",
+			tiff: modified(binary.LittleEndian, func(data []byte) {
+				binary.LittleEndian.PutUint32(data[testIfd0Offset+26:], 0xFFFFFFFF)
+			}),
+			wantDate: dateTimeOriginal,
+		},
+		{
+			name: "thumbnail offset out of range",
+			tiff: modified(binary.BigEndian, func(data []byte) {
+				binary.BigEndian.PutUint32(data[testIfd1Offset+2+8:], 0xFFFFFFFF)
+			}),
+			wantDate: dateTimeOriginal,
+		},
+		{
+			name: "thumbnail length out of range",
+			tiff: modified(binary.LittleEndian, func(data []byte) {
+				binary.LittleEndian.PutUint32(data[testIfd1Offset+14+8:], 0xFFFFFFFF)
+			}),
+			wantDate: dateTimeOriginal,
+		},
+		{
+			name:     "truncated thumbnail",
+			tiff:     buildExifTiff(binary.BigEndian)[:testThumbnailDataOffset+2],
+			wantDate: dateTimeOriginal,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exif, err := readExif(bytes.NewReader(exifJpeg(test.tiff)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("readExif() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readExif() error = %v", err)
+			}
+
+			if !exif.dateTaken.Equal(test.wantDate) {
+				t.Errorf("dateTaken = %v, want %v", exif.dateTaken, test.wantDate)
+			}
+
+			if test.wantThumbnail && !bytes.Equal(exif.thumbnail, testThumbnail) {
+				t.Errorf("thumbnail = %x, want %x", exif.thumbnail, testThumbnail)
+			}
+			if !test.wantThumbnail && exif.thumbnail != nil {
+				t.Errorf("thumbnail = %x, want none", exif.thumbnail)
+			}
+		})
+	}
+}
+
+func TestReadExifWithoutExif(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n")},
+		{"no app1 segment", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}},
+		{"app1 without exif", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x06, 'X', 'M', 'P', 0x00, 0xFF, 0xD9}},
+		{"truncated segment", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10, 0x00, 'E', 'x'}},
+		{"segment length too short", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readExif(bytes.NewReader(test.data)); err != errNoExif {
+				t.Errorf("readExif() error = %v, want %v", err, errNoExif)
+			}
+		})
+	}
+}
+
+func FuzzReadExif(f *testing.F) {
+	f.Add(buildExifTiff(binary.LittleEndian))
+	f.Add(buildExifTiff(binary.BigEndian))
+	f.Add([]byte("II*\x00\x08\x00\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, tiff []byte) {
+		exif, err := readExif(bytes.NewReader(exifJpeg(tiff)))
+		if err == nil && exif == nil {
+			t.Fatalf("readExif() returned neither data nor an error")
+		}
+	})
+}
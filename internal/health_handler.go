@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusNotReady = "unavailable"
+)
+
+// HealthCheck is the result of one of the readiness checks
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthStatus is sent as the JSON body of the health and readiness endpoints
+type HealthStatus struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthHandler struct {
+	imageDir     string
+	cacheDir     string
+	imageStorage ImageStorageInterface
+}
+
+// NewHealthHandler creates the handler of the health endpoints. cacheDir is empty when caching is disabled.
+func NewHealthHandler(imageDir string, cacheDir string, imageStorage ImageStorageInterface) *HealthHandler {
+	return &HealthHandler{
+		imageDir:     imageDir,
+		cacheDir:     cacheDir,
+		imageStorage: imageStorage,
+	}
+}
+
+// HandleHealth reports that the process is up and serving requests. It is meant as a liveness probe
+// and always returns 200 OK.
+func (h *HealthHandler) HandleHealth(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(HealthStatus{Status: HealthStatusOK})
+}
+
+// HandleReady reports whether the service can serve images. It returns 200 OK when the image directory
+// is readable, at least one image is loaded, and the cache directory, if any, is writable.
+// Otherwise it returns 503 Service Unavailable. The body lists the result of every check.
+func (h *HealthHandler) HandleReady(c fiber.Ctx) error {
+	checks := []HealthCheck{
+		h.checkImageDir(),
+		h.checkImages(),
+	}
+	if h.cacheDir != "" {
+		checks = append(checks, h.checkCacheDir())
+	}
+
+	status := HealthStatus{Status: HealthStatusOK, Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			status.Status = HealthStatusNotReady
+		}
+	}
+
+	if status.Status != HealthStatusOK {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(status)
+	}
+	return c.Status(fiber.StatusOK).JSON(status)
+}
+
+func (h *HealthHandler) checkImageDir() HealthCheck {
+	check := HealthCheck{Name: "imageDir"}
+
+	dir, err := os.Open(h.imageDir)
+	if err == nil {
+		// An empty directory is still readable, the images check reports it
+		if _, err = dir.Readdirnames(1); err == io.EOF {
+			err = nil
+		}
+		dir.Close()
+	}
+
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	check.OK = true
+	return check
+}
+
+func (h *HealthHandler) checkImages() HealthCheck {
+	check := HealthCheck{Name: "images"}
+
+	if h.imageStorage.Empty() {
+		check.Detail = "no images loaded"
+		return check
+	}
+
+	check.OK = true
+	check.Detail = fmt.Sprintf("%d images loaded", h.imageStorage.ImageCount())
+	return check
+}
+
+// checkCacheDir creates and removes a file in the cache directory
+func (h *HealthHandler) checkCacheDir() HealthCheck {
+	check := HealthCheck{Name: "cacheDir"}
+
+	file, err := os.CreateTemp(h.cacheDir, ".readyz.*.tmp")
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	file.Close()
+
+	if err := os.Remove(file.Name()); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	check.OK = true
+	return check
+}
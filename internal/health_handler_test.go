@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// ready requests /readyz of handler and returns the status code and body
+func ready(t *testing.T, handler *HealthHandler) (int, HealthStatus) {
+	t.Helper()
+
+	app := fiber.New()
+	app.Get("/readyz", handler.HandleReady)
+	response := testRequest(t, app, "/readyz", nil)
+
+	var status HealthStatus
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, status
+}
+
+// failedChecks returns the names of the checks of status that failed
+func failedChecks(status HealthStatus) []string {
+	var failed []string
+	for _, check := range status.Checks {
+		if !check.OK {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
+
+func TestHandleReady(t *testing.T) {
+	imageDir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(imageDir, "a.jpg"), 40, 30)
+	storage := newTestStorage(t, imageDir)
+
+	code, status := ready(t, NewHealthHandler(imageDir, t.TempDir(), storage))
+	if code != fiber.StatusOK || status.Status != HealthStatusOK || len(failedChecks(status)) != 0 {
+		t.Errorf("ready = %d %q with failed checks %v, want 200 %q", code, status.Status, failedChecks(status), HealthStatusOK)
+	}
+	if len(status.Checks) != 3 {
+		t.Errorf("ready has %d checks, want 3", len(status.Checks))
+	}
+}
+
+func TestHandleReadyWithoutImages(t *testing.T) {
+	imageDir := t.TempDir()
+
+	code, status := ready(t, NewHealthHandler(imageDir, "", newTestStorage(t, imageDir)))
+	if code != fiber.StatusServiceUnavailable || status.Status != HealthStatusNotReady {
+		t.Errorf("ready = %d %q, want 503 %q", code, status.Status, HealthStatusNotReady)
+	}
+	if failed := failedChecks(status); len(failed) != 1 || failed[0] != "images" {
+		t.Errorf("failed checks = %v, want [images]", failed)
+	}
+}
+
+func TestHandleReadyWithUnwritableCache(t *testing.T) {
+	imageDir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(imageDir, "a.jpg"), 40, 30)
+	storage := newTestStorage(t, imageDir)
+
+	readOnly := t.TempDir()
+	if err := os.Chmod(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(readOnly, 0755) })
+
+	notDir := filepath.Join(t.TempDir(), "cache")
+	writeTestFile(t, notDir, nil)
+
+	tests := []struct {
+		name     string
+		cacheDir string
+	}{
+		{"read-only", readOnly},
+		{"not a directory", notDir},
+		{"missing", filepath.Join(t.TempDir(), "missing")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.cacheDir == readOnly && os.Geteuid() == 0 {
+				t.Skip("root can write to read-only directories")
+			}
+
+			code, status := ready(t, NewHealthHandler(imageDir, test.cacheDir, storage))
+			if code != fiber.StatusServiceUnavailable || status.Status != HealthStatusNotReady {
+				t.Errorf("ready = %d %q, want 503 %q", code, status.Status, HealthStatusNotReady)
+			}
+			if failed := failedChecks(status); len(failed) != 1 || failed[0] != "cacheDir" {
+				t.Errorf("failed checks = %v, want [cacheDir]", failed)
+			}
+			for _, check := range status.Checks {
+				if check.Name == "cacheDir" && check.Detail == "" {
+					t.Errorf("cacheDir check failed without a detail")
+				}
+			}
+		})
+	}
+}
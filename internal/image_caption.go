@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/nao1215/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// CaptionMaxLength is the maximum number of characters accepted in a caption
+	CaptionMaxLength = 200
+
+	captionDateFormat = "January 2, 2006"
+	captionEllipsis   = "…"
+)
+
+// captionFont is the embedded Go Regular font, parsed on first use
+var captionFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+// expandCaption replaces the {date}, {folder}, {filename} and {name} placeholders in template with details of the image
+func expandCaption(template string, info ImageInfo) string {
+	replacer := strings.NewReplacer(
+		"{date}", info.DateTaken.Format(captionDateFormat),
+		"{folder}", info.Folder,
+		"{filename}", path.Base(info.Key),
+		"{name}", strings.TrimSuffix(path.Base(info.Key), path.Ext(info.Key)),
+	)
+	return replacer.Replace(template)
+}
+
+// drawCaption renders text on a band across the top or bottom of img. Text that does not fit is truncated with an ellipsis.
+func drawCaption(img image.Image, text string, size float64, textColor, background color.NRGBA, position string) (*image.NRGBA, error) {
+	dst := imaging.Clone(img)
+
+	ttf, err := captionFont()
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	bounds := dst.Bounds()
+	metrics := face.Metrics()
+	padding := max(1, int(size/2))
+	bandHeight := min((metrics.Ascent+metrics.Descent).Ceil()+2*padding, bounds.Dy())
+
+	band := image.Rect(bounds.Min.X, bounds.Max.Y-bandHeight, bounds.Max.X, bounds.Max.Y)
+	if position == CaptionTop {
+		band = image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+bandHeight)
+	}
+	draw.Draw(dst, band, image.NewUniform(background), image.Point{}, draw.Over)
+
+	drawer := font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+		Dot:  fixed.P(band.Min.X+padding, band.Min.Y+padding+metrics.Ascent.Ceil()),
+	}
+	drawer.DrawString(fitCaption(drawer, text, fixed.I(bounds.Dx()-2*padding)))
+
+	return dst, nil
+}
+
+// fitCaption shortens text until it fits within maxWidth when drawn
+func fitCaption(drawer font.Drawer, text string, maxWidth fixed.Int26_6) string {
+	if drawer.MeasureString(text) <= maxWidth {
+		return text
+	}
+
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		candidate := strings.TrimRight(string(runes), " ") + captionEllipsis
+		if drawer.MeasureString(candidate) <= maxWidth {
+			return candidate
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/nao1215/imaging"
+)
+
+const (
+	// autoSharpenSigma is the blur radius of the unsharp mask applied after downscaling
+	autoSharpenSigma = 0.7
+
+	// autoSharpenMinScale is the smallest downscale factor that triggers automatic sharpening
+	autoSharpenMinScale = 1.5
+)
+
+// sepia tints the image with the classic brownish sepia tone
+func sepia(img image.Image) *image.NRGBA {
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return color.NRGBA{
+			R: clampUint8(0.393*r + 0.769*g + 0.189*b),
+			G: clampUint8(0.349*r + 0.686*g + 0.168*b),
+			B: clampUint8(0.272*r + 0.534*g + 0.131*b),
+			A: c.A,
+		}
+	})
+}
+
+// duotone maps the luminance of every pixel onto the gradient between dark and light
+func duotone(img image.Image, dark, light color.NRGBA) *image.NRGBA {
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		l := (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) / 255
+		return color.NRGBA{
+			R: clampUint8(float64(dark.R) + (float64(light.R)-float64(dark.R))*l),
+			G: clampUint8(float64(dark.G) + (float64(light.G)-float64(dark.G))*l),
+			B: clampUint8(float64(dark.B) + (float64(light.B)-float64(dark.B))*l),
+			A: c.A,
+		}
+	})
+}
+
+// pixelate replaces every blockSize x blockSize block of the image with its average color
+func pixelate(img image.Image, blockSize int) *image.NRGBA {
+	bounds := img.Bounds()
+	width := max(1, (bounds.Dx()+blockSize-1)/blockSize)
+	height := max(1, (bounds.Dy()+blockSize-1)/blockSize)
+
+	small := imaging.Resize(img, width, height, imaging.Box)
+	return imaging.Resize(small, bounds.Dx(), bounds.Dy(), imaging.NearestNeighbor)
+}
+
+// vignette darkens the image towards its corners. A strength of 1 turns the corners black.
+func vignette(img image.Image, strength float64) *image.NRGBA {
+	dst := imaging.Clone(img)
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	centerX, centerY := float64(width)/2, float64(height)/2
+	maxDistance := math.Hypot(centerX, centerY)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			distance := math.Hypot(float64(x)+0.5-centerX, float64(y)+0.5-centerY) / maxDistance
+			factor := 1 - strength*distance*distance
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = clampUint8(float64(dst.Pix[i]) * factor)
+			dst.Pix[i+1] = clampUint8(float64(dst.Pix[i+1]) * factor)
+			dst.Pix[i+2] = clampUint8(float64(dst.Pix[i+2]) * factor)
+		}
+	}
+
+	return dst
+}
+
+// unsharpMask sharpens the image by adding amount times the difference between the image and a blurred copy
+func unsharpMask(img image.Image, sigma, amount float64) *image.NRGBA {
+	dst := imaging.Clone(img)
+	blurred := imaging.Blur(dst, sigma)
+
+	for i := range dst.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		value := float64(dst.Pix[i])
+		dst.Pix[i] = clampUint8(value + amount*(value-float64(blurred.Pix[i])))
+	}
+
+	return dst
+}
+
+// autoSharpenAmount returns how strongly to sharpen an image that was downscaled by scaleFactor.
+// Small reductions are left alone, larger ones get progressively more sharpening.
+func autoSharpenAmount(scaleFactor float64) float64 {
+	if scaleFactor < autoSharpenMinScale {
+		return 0
+	}
+	return math.Min(0.25*math.Log2(scaleFactor), 1)
+}
+
+// pad fits img inside width x height and fills the remaining space with background,
+// or with a blurred copy of img stretched over the whole area when blurBackground is set
+func pad(img image.Image, width, height int, background color.NRGBA, blurBackground bool, filter imaging.ResampleFilter) *image.NRGBA {
+	var canvas *image.NRGBA
+	if blurBackground {
+		canvas = imaging.Fill(img, width, height, imaging.Center, imaging.Box)
+		canvas = imaging.Blur(canvas, padBlurSigma(width, height))
+	} else {
+		canvas = imaging.New(width, height, background)
+	}
+
+	return imaging.OverlayCenter(canvas, imaging.Fit(img, width, height, filter), 1)
+}
+
+// padBlurSigma scales the background blur with the output so it looks the same at every size
+func padBlurSigma(width, height int) float64 {
+	return math.Max(2, float64(max(width, height))/40)
+}
+
+// border draws a frame of the given width and color over the edges of img
+func border(img image.Image, width int, borderColor color.NRGBA) *image.NRGBA {
+	dst := imaging.Clone(img)
+	bounds := dst.Bounds()
+	fill := image.NewUniform(borderColor)
+
+	edges := []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+width),
+		image.Rect(bounds.Min.X, bounds.Max.Y-width, bounds.Max.X, bounds.Max.Y),
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+width, bounds.Max.Y),
+		image.Rect(bounds.Max.X-width, bounds.Min.Y, bounds.Max.X, bounds.Max.Y),
+	}
+	for _, edge := range edges {
+		draw.Draw(dst, edge.Intersect(bounds), fill, image.Point{}, draw.Over)
+	}
+
+	return dst
+}
+
+// roundCorners makes the area outside corners of the given radius transparent
+func roundCorners(img image.Image, radius int) *image.NRGBA {
+	dst := imaging.Clone(img)
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	r := float64(min(radius, width/2, height/2))
+
+	applyMask(dst, func(x, y float64) float64 {
+		cx := math.Max(r, math.Min(x, float64(width)-r))
+		cy := math.Max(r, math.Min(y, float64(height)-r))
+		if cx == x && cy == y {
+			return 1
+		}
+		return r - math.Hypot(x-cx, y-cy) + 0.5
+	})
+
+	return dst
+}
+
+// circleMask makes everything outside the largest circle centered in the image transparent
+func circleMask(img image.Image) *image.NRGBA {
+	dst := imaging.Clone(img)
+	width, height := float64(dst.Bounds().Dx()), float64(dst.Bounds().Dy())
+	r := math.Min(width, height) / 2
+
+	applyMask(dst, func(x, y float64) float64 {
+		return r - math.Hypot(x-width/2, y-height/2) + 0.5
+	})
+
+	return dst
+}
+
+// applyMask scales the alpha of every pixel by coverage, which is clamped to [0, 1].
+// coverage is called with the center of the pixel so edges are anti-aliased.
+func applyMask(img *image.NRGBA, coverage func(x, y float64) float64) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := math.Max(0, math.Min(1, coverage(float64(x)+0.5, float64(y)+0.5)))
+			if c < 1 {
+				i := y*img.Stride + x*4 + 3
+				img.Pix[i] = clampUint8(float64(img.Pix[i]) * c)
+			}
+		}
+	}
+}
@@ -1,11 +1,22 @@
 package internal
 
 import (
-	"image/jpeg"
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
 	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ImageHandlerInterface interface {
@@ -13,97 +24,694 @@ type ImageHandlerInterface interface {
 }
 
 type ImageHandler struct {
-	settings     ServiceSettings
-	imageStorage ImageStorageInterface
-	imagePicker  ImagePickerInterface
+	settings      ServiceSettings
+	imageStorage  ImageStorageInterface
+	imagePicker   ImagePickerInterface
+	transformPool *TransformPool
+	fingerprint   string    // Hash of the server settings that change images, part of every ETag and cache key
+	settingsTime  time.Time // When the server settings took effect, no image is served as older
 }
 
-func NewImageHandler(settings ServiceSettings, imageStorage ImageStorageInterface, imagePicker ImagePickerInterface) *ImageHandler {
-	return &ImageHandler{
-		settings:     settings,
-		imageStorage: imageStorage,
-		imagePicker:  imagePicker,
+// NewImageHandler creates the handler of the image routes. It fails when the watermark file can not be read.
+func NewImageHandler(settings ServiceSettings, imageStorage ImageStorageInterface, imagePicker ImagePickerInterface, transformPool *TransformPool) (*ImageHandler, error) {
+	fingerprint, err := settings.outputFingerprint()
+	if err != nil {
+		return nil, err
 	}
+
+	return &ImageHandler{
+		settings:      settings,
+		imageStorage:  imageStorage,
+		imagePicker:   imagePicker,
+		transformPool: transformPool,
+		fingerprint:   fingerprint,
+		settingsTime:  time.Now(),
+	}, nil
 }
 
 // HandleRequest processes the incoming HTTP request, applies transformations to the image,
 // and serves the image. It supports parameters for width, height, blur, grayscale, and resize mode.
 //
 // Path Parameters:
-// - width: The width to resize the image to (required).
-// - height: The height to resize the image to (optional, default is 0).
+// - id: The key of the image to serve (optional). Without id or seed a random image is served.
+// - seed: Any string that always selects the same image (optional).
+// - width: The width to resize the image to (required). Range is 1 to the server's -maxWidth.
+// - height: The height to resize the image to (optional, default is 0). Range is 0 to the server's -maxHeight.
 // Query Parameters:
-// - blur: The amount of blur to apply to the image (optional, default is 0).
+// - blur: The amount of blur to apply to the image (optional, default is 0). Range is 0 to the server's -maxBlur.
 // - grayscale: Whether to convert the image to grayscale (optional, default is false).
 // - greyscale: Alias for grayscale (optional, default is false).
-// - resizemode: The mode to use for resizing the image (optional, default is "fit"). Valid values are "none", "fill", and "fit".
+// - resizemode: The mode to use for resizing the image (optional, default is "fit"). Valid values are "none", "fill", "fit", and "pad".
+// - background: What to fill the space around the image with in pad mode (optional, default is "000000"). Either a hex color or "blur".
+// - border: The width of a frame drawn over the edges of the image, optionally followed by a hex color (optional). e.g. "8,ffffff".
+// - gravity: Where to crop from in fill mode (optional, default is "center"). Valid values are "center" and "smart".
+// - rotate: Degrees to rotate the image clockwise before resizing (optional, default is 0). Valid values are 0, 90, 180, and 270.
+// - flip: Mirror the image before resizing (optional). Valid values are "h" and "v".
+// - brightness: Percentage to change the brightness by (optional, default is 0). Range is -100 to 100.
+// - contrast: Percentage to change the contrast by (optional, default is 0). Range is -100 to 100.
+// - saturation: Percentage to change the saturation by (optional, default is 0). Range is -100 to 100.
+// - hue: Degrees to shift the hue by (optional, default is 0). Range is -180 to 180.
+// - gamma: Gamma correction to apply (optional, default is 1). Range is 0.1 to 10.
+// - sepia: Whether to apply a sepia tone (optional, default is false).
+// - duotone: Two hex colors, dark and light, to map the image onto (optional). e.g. "203040,f0e0c0".
+// - pixelate: The block size in pixels to pixelate the image with (optional, default is 0). Range is 0 to 256.
+// - vignette: How much to darken the corners (optional, default is 0). Range is 0 to 1.
+// - filter: The resampling filter used when resizing (optional, default is the server's -resizeFilter).
+// Valid values are "lanczos", "catmullrom", "linear", "box", and "nearest".
+// - watermark: Whether to composite the server's watermark onto the image (optional, default is true when the server runs with -watermark).
+// - text: Caption to draw on the image (optional, default is the server's -caption). Supports the {date}, {folder}, {filename} and {name} placeholders.
+// An empty value disables the server's caption.
+// - textsize: The caption font size in pixels (optional, default is the server's -captionSize). Range is 6 to 200.
+// - textcolor: The caption color as hex (optional, default is the server's -captionColor).
+// - textbg: The caption background band color as hex, including alpha (optional, default is the server's -captionBackground).
+// - textposition: Where to draw the caption (optional, default is the server's -captionPosition). Valid values are "top" and "bottom".
+// - radius: The radius of rounded corners in pixels (optional, default is 0). Range is 0 to 1000.
+// - mask: Cut the image into a shape (optional). Valid values are "circle".
+// Images with rounded corners or a mask are returned as PNG so the corners are transparent.
+// - dpr: The device pixel ratio (optional, default is 1). Range is 1 to 4. Width, height, blur, pixelate, border, radius, and textsize
+// are multiplied by it. It is lowered when the scaled size would exceed the server's -maxWidth, -maxHeight or -maxPixels,
+// using the height that follows from the source when only the width is requested.
+// - sharpen: The sigma of the sharpening applied after resizing, or "auto" to sharpen based on how much
+// the image was downscaled (optional, default is 0 or "auto" when the server runs with -autoSharpen). Range is 0 to 10.
+//
+// HEAD requests get the same headers as GET requests, including Content-Length, ETag and the
+// X-Image-Width and X-Image-Height of the image, without the body.
+//
+// Images requested by id or seed are sent with an ETag and Last-Modified header, and requests for them are answered
+// with 304 Not Modified when If-None-Match or If-Modified-Since show the client already has the image.
+// Images get the server's -stableCacheControl header when requested by id or seed and its
+// -randomCacheControl header otherwise. Errors are sent without one.
 //
 // Returns:
 // - 200 OK: If the image is successfully processed and served.
-// - 400 Bad Request: If any of the parameters are invalid.
+// - 304 Not Modified: If the client's copy of an id or seed image is still current.
+// - 400 Bad Request: If any of the parameters are invalid, the output would exceed -maxPixels,
+// or the source would be enlarged more than -maxUpscale times. Random images are made smaller instead
+// when it is their source that takes the output over -maxHeight, -maxPixels or -maxUpscale.
+// - 404 Not Found: If there is no image with the requested id.
 // - 500 Internal Server Error: If there is an error picking or processing the image.
+// - 503 Service Unavailable: If the transform queue is full, the request waited in it too long, or it waited too long for
+// memory to decode the image under the server's -maxDecodeMemory, in which case Retry-After is set,
+// or if processing took longer than the server's -requestTimeout.
+//
+// Work on the image stops as soon as the client disconnects.
+//
+// Errors are returned as a JSON RequestError.
 func (p *ImageHandler) HandleRequest(c fiber.Ctx) error {
 
-	// pick a random photo
-	imageKey := p.imagePicker.Image()
-	if imageKey == "" {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to pick a photo")
+	ctx, finishSpan := startRequestSpan(c, "HandleRequest")
+	defer finishSpan()
+
+	imageKey, deterministic, requestErr := p.pickImage(ctx, c)
+	if requestErr != nil {
+		return sendError(c, requestErr)
 	}
 
 	slog.Debug("Serving image", "image", imageKey)
 
-	width, err := strconv.Atoi(c.Params("width"))
+	info, err := p.imageStorage.Info(imageKey)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid width")
+		slog.Error("Failed to read image details", "image", imageKey, "error", err)
+		return sendError(c, serverError("Failed to read image details"))
+	}
+
+	imageSettings, requestErr := p.parseImageSettings(c, info)
+	if requestErr != nil {
+		return sendError(c, requestErr)
+	}
+
+	if !deterministic {
+		imageSettings = p.fitToSource(imageSettings, info)
+	}
+
+	if requestErr := p.checkOutputSize(imageSettings, info); requestErr != nil {
+		return sendError(c, requestErr)
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(settingsAttributes(imageKey, imageSettings)...)
+
+	var etag string
+	if deterministic {
+		etag = p.etag(imageKey, imageSettings)
+		setValidators(c, etag, p.lastModified(info))
+		if c.Fresh() {
+			p.setCacheControl(c, deterministic)
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		// Only the image itself is sent with its validators, errors below must go out without them
+		c.Response().Header.Del(fiber.HeaderETag)
+		c.Response().Header.Del(fiber.HeaderLastModified)
+	}
+
+	slog.Debug("settings", "width", imageSettings.Width,
+		"height", imageSettings.Height,
+		"grayscale", imageSettings.Grayscale,
+		"blur", imageSettings.Blur,
+		"resizeMode", imageSettings.ResizeMode,
+		"gravity", imageSettings.Gravity,
+		"rotate", imageSettings.Rotate,
+		"flip", imageSettings.Flip,
+		"brightness", imageSettings.Brightness,
+		"contrast", imageSettings.Contrast,
+		"saturation", imageSettings.Saturation,
+		"hue", imageSettings.Hue,
+		"gamma", imageSettings.Gamma,
+		"sepia", imageSettings.Sepia,
+		"duotone", imageSettings.Duotone,
+		"pixelate", imageSettings.Pixelate,
+		"vignette", imageSettings.Vignette,
+		"sharpen", imageSettings.Sharpen,
+		"autoSharpen", imageSettings.AutoSharpen,
+		"filter", imageSettings.Filter,
+		"watermark", imageSettings.Watermark,
+		"text", imageSettings.Text,
+		"padBackground", imageSettings.PadBackground,
+		"padBlur", imageSettings.PadBlur,
+		"borderWidth", imageSettings.BorderWidth,
+		"borderColor", imageSettings.BorderColor,
+		"radius", imageSettings.Radius,
+		"mask", imageSettings.Mask)
+
+	ctx, cancel := withClientDisconnect(ctx, c.RequestCtx().Conn())
+	defer cancel()
+
+	if p.settings.RequestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, p.settings.RequestTimeout)
+		defer cancelTimeout()
+	}
+
+	slog.Debug("Transform queue", "depth", p.transformPool.QueueDepth(), "active", p.transformPool.Active())
+
+	// The image is encoded in full before anything is sent so the response has an accurate Content-Length.
+	// Only images that are not cached yet wait for a worker of the transform pool.
+	data, err := p.imageStorage.ImageDataWithTransform(ctx, imageKey, imageSettings)
+
+	if err == ErrQueueFull || err == ErrQueueTimeout || err == ErrMemoryTimeout {
+		slog.Warn("Rejecting request, server is busy", "image", imageKey, "reason", err,
+			"depth", p.transformPool.QueueDepth(), "active", p.transformPool.Active())
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(p.transformPool.RetryAfter().Seconds()))))
+		return sendError(c, &RequestError{Status: fiber.StatusServiceUnavailable, Message: "Server is busy, try again later"})
+	}
+
+	if isContextError(err) {
+		return p.sendCanceled(ctx, c, imageKey)
 	}
 
-	height, err := strconv.Atoi(c.Params("height", "0"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid height")
+		return sendError(c, serverError("Failed to resize image"))
+	}
+
+	if config, err := decodeConfig(bytes.NewReader(data), imageSettings.mimeType()); err == nil {
+		c.Set(HeaderImageWidth, strconv.Itoa(config.Width))
+		c.Set(HeaderImageHeight, strconv.Itoa(config.Height))
+	}
+
+	if deterministic {
+		setValidators(c, etag, p.lastModified(info))
+	}
+	p.setCacheControl(c, deterministic)
+	c.Set(fiber.HeaderContentType, imageSettings.mimeType())
+	// fasthttp sets Content-Length from the body, and leaves the body out of responses to HEAD requests
+	return c.Status(fiber.StatusOK).Send(data)
+}
+
+// setCacheControl sets the Cache-Control header configured for random or for id and seed images
+func (p *ImageHandler) setCacheControl(c fiber.Ctx, deterministic bool) {
+	cacheControl := p.settings.RandomCacheControl
+	if deterministic {
+		cacheControl = p.settings.StableCacheControl
+	}
+
+	if cacheControl != "" {
+		c.Set(fiber.HeaderCacheControl, cacheControl)
+	}
+}
+
+// sendCanceled answers a request whose processing stopped because ctx is done, either because
+// the client disconnected or because the request ran past the server's -requestTimeout
+func (p *ImageHandler) sendCanceled(ctx context.Context, c fiber.Ctx, imageKey string) error {
+	if errors.Is(context.Cause(ctx), errClientDisconnected) {
+		slog.Debug("Client disconnected, abandoning request", "image", imageKey)
+		return c.SendStatus(statusClientClosedRequest)
 	}
 
-	blur, err := strconv.ParseFloat(c.Query("blur", "0"), 64)
+	slog.Warn("Request exceeded the processing deadline", "image", imageKey, "timeout", p.settings.RequestTimeout)
+	return sendError(c, &RequestError{Status: fiber.StatusServiceUnavailable, Message: "Request took too long to process"})
+}
+
+// pickImage returns the key of the image the request is for. deterministic reports whether the
+// request always gets the same image, which is the case for id and seed requests.
+func (p *ImageHandler) pickImage(ctx context.Context, c fiber.Ctx) (imageKey string, deterministic bool, requestErr *RequestError) {
+	_, span := tracer.Start(ctx, "pickImage")
+	defer func() {
+		span.SetAttributes(attribute.String("image.key", imageKey), attribute.Bool("image.deterministic", deterministic))
+		if requestErr != nil {
+			span.SetStatus(codes.Error, requestErr.Message)
+		}
+		span.End()
+	}()
+
+	if id := c.Params("id"); id != "" {
+		key, err := url.PathUnescape(id)
+		if err != nil || !p.imageStorage.Contains(key) {
+			return "", false, &RequestError{Status: fiber.StatusNotFound, Message: "Image not found", Parameter: "id"}
+		}
+		return key, true, nil
+	}
+
+	if seed := c.Params("seed"); seed != "" {
+		imageKey = p.imagePicker.ImageForSeed(seed)
+		deterministic = true
+	} else {
+		imageKey = p.imagePicker.Image()
+	}
+
+	if imageKey == "" {
+		return "", false, serverError("Failed to pick a photo")
+	}
+	return imageKey, deterministic, nil
+}
+
+// etag returns the ETag of the image. It is derived from the content of the source image and the settings,
+// which include the fingerprint of the server settings, so it changes whenever the served image would.
+// It is empty when the source can not be hashed.
+func (p *ImageHandler) etag(imageKey string, settings ImageSettings) string {
+	sourceHash, err := p.imageStorage.ContentHash(imageKey)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid blur")
+		slog.Warn("Failed to hash image, sending it without an ETag", "image", imageKey, "error", err)
+		return ""
+	}
+	return `"` + hashString(sourceHash+settings.cacheKey(imageKey)) + `"`
+}
+
+// lastModified returns the later of the modification time of the source and the time the server settings
+// took effect, so clients that only send If-Modified-Since get new images after the settings changed as well
+func (p *ImageHandler) lastModified(info ImageInfo) time.Time {
+	if info.ModTime.After(p.settingsTime) {
+		return info.ModTime
+	}
+	return p.settingsTime
+}
+
+// setValidators sets the ETag, when there is one, and the Last-Modified headers of the response
+func setValidators(c fiber.Ctx, etag string, lastModified time.Time) {
+	if etag != "" {
+		c.Set(fiber.HeaderETag, etag)
+	}
+	c.Set(fiber.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+}
+
+// parseImageSettings reads the path and query parameters of the request into ImageSettings.
+// info is used to expand the placeholders of the caption.
+func (p *ImageHandler) parseImageSettings(c fiber.Ctx, info ImageInfo) (ImageSettings, *RequestError) {
+	width, err := strconv.Atoi(c.Params("width"))
+	if err != nil || width < 1 || width > p.settings.MaxWidth {
+		return ImageSettings{}, invalidParameter("width", "Invalid width parameter. Must be between 1 and %d", p.settings.MaxWidth)
+	}
+
+	height, err := strconv.Atoi(c.Params("height", "0"))
+	if err != nil || height < 0 || height > p.settings.MaxHeight {
+		return ImageSettings{}, invalidParameter("height", "Invalid height parameter. Must be between 0 and %d", p.settings.MaxHeight)
+	}
+
+	blur, requestErr := queryFloatInRange(c, "blur", 0, 0, p.settings.MaxBlur)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
 	}
 
 	grayscale, err := strconv.ParseBool(c.Query("grayscale", "false"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid grayscale")
+		return ImageSettings{}, invalidParameter("grayscale", "Invalid grayscale parameter. Must be true or false")
 	}
 
 	if grayscale == false {
 		grayscale, err = strconv.ParseBool(c.Query("greyscale", "false"))
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid greyscale")
+			return ImageSettings{}, invalidParameter("greyscale", "Invalid greyscale parameter. Must be true or false")
 		}
 	}
 
 	resizeMode := c.Query("resizemode", "fit")
-	if resizeMode != "none" && resizeMode != "fill" && resizeMode != "fit" {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid resizemode parameter. Must be none, fill, or fit")
+	if resizeMode != "none" && resizeMode != "fill" && resizeMode != "fit" && resizeMode != "pad" {
+		return ImageSettings{}, invalidParameter("resizemode", "Invalid resizemode parameter. Must be none, fill, fit, or pad")
 	}
 
-	imageSettings := ImageSettings{
-		Width:      width,
-		Height:     height,
-		Blur:       blur,
-		Grayscale:  grayscale,
-		ResizeMode: resizeMode,
+	var padBackground color.NRGBA
+	background := c.Query("background", "000000")
+	padBlur := background == "blur"
+	if !padBlur {
+		padBackground, err = parseHexColor(background)
+		if err != nil {
+			return ImageSettings{}, invalidParameter("background", "Invalid background parameter. Must be a hex color or blur")
+		}
 	}
 
-	slog.Debug("settings", "width", imageSettings.Width,
-		"height", imageSettings.Height,
-		"grayscale", imageSettings.Grayscale,
-		"blur", imageSettings.Blur,
-		"resizeMode", imageSettings.ResizeMode)
+	var borderWidth int
+	borderColor := color.NRGBA{A: 255}
+	if value := c.Query("border"); value != "" {
+		width, hex, hasColor := strings.Cut(value, ",")
+		borderWidth, err = strconv.Atoi(width)
+		if err != nil || borderWidth < 0 || borderWidth > 100 {
+			return ImageSettings{}, invalidParameter("border", "Invalid border parameter. Width must be between 0 and 100")
+		}
+		if hasColor {
+			borderColor, err = parseHexColor(hex)
+			if err != nil {
+				return ImageSettings{}, invalidParameter("border", "Invalid border parameter. Color must be a hex color")
+			}
+		}
+	}
+
+	gravity := c.Query("gravity", GravityCenter)
+	if gravity != GravityCenter && gravity != GravitySmart {
+		return ImageSettings{}, invalidParameter("gravity", "Invalid gravity parameter. Must be center or smart")
+	}
+
+	rotate, err := strconv.Atoi(c.Query("rotate", "0"))
+	if err != nil || (rotate != 0 && rotate != 90 && rotate != 180 && rotate != 270) {
+		return ImageSettings{}, invalidParameter("rotate", "Invalid rotate parameter. Must be 0, 90, 180, or 270")
+	}
+
+	flip := c.Query("flip")
+	if flip != "" && flip != FlipHorizontal && flip != FlipVertical {
+		return ImageSettings{}, invalidParameter("flip", "Invalid flip parameter. Must be h or v")
+	}
+
+	brightness, requestErr := queryFloatInRange(c, "brightness", 0, -100, 100)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	contrast, requestErr := queryFloatInRange(c, "contrast", 0, -100, 100)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	saturation, requestErr := queryFloatInRange(c, "saturation", 0, -100, 100)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	hue, requestErr := queryFloatInRange(c, "hue", 0, -180, 180)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
 
-	img, err := p.imageStorage.ImageWithTransform(imageKey, imageSettings)
+	gamma, requestErr := queryFloatInRange(c, "gamma", 1, 0.1, 10)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	sepia, err := strconv.ParseBool(c.Query("sepia", "false"))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to resize image")
+		return ImageSettings{}, invalidParameter("sepia", "Invalid sepia parameter. Must be true or false")
+	}
+
+	var duotone []color.NRGBA
+	if value := c.Query("duotone"); value != "" {
+		colors := strings.Split(value, ",")
+		if len(colors) != 2 {
+			return ImageSettings{}, invalidParameter("duotone", "Invalid duotone parameter. Must be two hex colors separated by a comma")
+		}
+		for _, hex := range colors {
+			parsed, err := parseHexColor(hex)
+			if err != nil {
+				return ImageSettings{}, invalidParameter("duotone", "Invalid duotone parameter. Must be two hex colors separated by a comma")
+			}
+			duotone = append(duotone, parsed)
+		}
+	}
+
+	pixelate, err := strconv.Atoi(c.Query("pixelate", "0"))
+	if err != nil || pixelate < 0 || pixelate > 256 {
+		return ImageSettings{}, invalidParameter("pixelate", "Invalid pixelate parameter. Must be between 0 and 256")
+	}
+
+	vignette, requestErr := queryFloatInRange(c, "vignette", 0, 0, 1)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	filter := c.Query("filter", p.settings.ResizeFilter)
+	if !IsResampleFilter(filter) {
+		return ImageSettings{}, invalidParameter("filter", "Invalid filter parameter. Must be lanczos, catmullrom, linear, box, or nearest")
+	}
+
+	var sharpen float64
+	autoSharpen := p.settings.AutoSharpen
+	if value := c.Query("sharpen"); value == "auto" {
+		autoSharpen = true
+	} else if value != "" {
+		sharpen, requestErr = queryFloatInRange(c, "sharpen", 0, 0, 10)
+		if requestErr != nil {
+			return ImageSettings{}, requestErr
+		}
+		autoSharpen = false
+	}
+
+	watermark, err := strconv.ParseBool(c.Query("watermark", "true"))
+	if err != nil {
+		return ImageSettings{}, invalidParameter("watermark", "Invalid watermark parameter. Must be true or false")
+	}
+
+	text := p.settings.CaptionTemplate
+	if c.RequestCtx().QueryArgs().Has("text") {
+		text = c.Query("text")
+	}
+	if len([]rune(text)) > CaptionMaxLength {
+		return ImageSettings{}, invalidParameter("text", "Invalid text parameter. Must be at most %d characters", CaptionMaxLength)
+	}
+	text = expandCaption(text, info)
+
+	textSize, requestErr := queryFloatInRange(c, "textsize", p.settings.CaptionSize, 6, 200)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	textColor, err := parseHexColor(c.Query("textcolor", p.settings.CaptionColor))
+	if err != nil {
+		return ImageSettings{}, invalidParameter("textcolor", "Invalid textcolor parameter. Must be a hex color")
+	}
+
+	textBackground, err := parseHexColor(c.Query("textbg", p.settings.CaptionBackground))
+	if err != nil {
+		return ImageSettings{}, invalidParameter("textbg", "Invalid textbg parameter. Must be a hex color")
+	}
+
+	textPosition := c.Query("textposition", p.settings.CaptionPosition)
+	if textPosition != CaptionTop && textPosition != CaptionBottom {
+		return ImageSettings{}, invalidParameter("textposition", "Invalid textposition parameter. Must be top or bottom")
+	}
+
+	radius, err := strconv.Atoi(c.Query("radius", "0"))
+	if err != nil || radius < 0 || radius > 1000 {
+		return ImageSettings{}, invalidParameter("radius", "Invalid radius parameter. Must be between 0 and 1000")
+	}
+
+	mask := c.Query("mask")
+	if mask != "" && mask != MaskCircle {
+		return ImageSettings{}, invalidParameter("mask", "Invalid mask parameter. Must be circle")
+	}
+
+	dpr, requestErr := queryFloatInRange(c, "dpr", 1, 1, 4)
+	if requestErr != nil {
+		return ImageSettings{}, requestErr
+	}
+
+	sourceWidth, sourceHeight := orientedSourceSize(ImageSettings{Rotate: rotate}, info)
+	dpr = p.effectiveDpr(dpr, width, height, sourceWidth, sourceHeight)
+	if dpr != 1 {
+		width = scaleByDpr(width, dpr)
+		height = scaleByDpr(height, dpr)
+		blur = math.Min(blur*dpr, p.settings.MaxBlur)
+		pixelate = scaleByDpr(pixelate, dpr)
+		borderWidth = scaleByDpr(borderWidth, dpr)
+		radius = scaleByDpr(radius, dpr)
+		textSize *= dpr
+	}
+
+	return ImageSettings{
+		Width:       width,
+		Height:      height,
+		Blur:        blur,
+		Grayscale:   grayscale,
+		ResizeMode:  resizeMode,
+		Gravity:     gravity,
+		Rotate:      rotate,
+		Flip:        flip,
+		Brightness:  brightness,
+		Contrast:    contrast,
+		Saturation:  saturation,
+		Gamma:       gamma,
+		Hue:         hue,
+		Sepia:       sepia,
+		Duotone:     duotone,
+		Pixelate:    pixelate,
+		Vignette:    vignette,
+		Sharpen:     sharpen,
+		AutoSharpen: autoSharpen,
+		Filter:      filter,
+		Watermark:   watermark && p.settings.WatermarkFile != "",
+		Fingerprint: p.fingerprint,
+
+		PadBackground: padBackground,
+		PadBlur:       padBlur,
+		BorderWidth:   borderWidth,
+		BorderColor:   borderColor,
+
+		Radius: radius,
+		Mask:   mask,
+
+		Text:           text,
+		TextSize:       textSize,
+		TextColor:      textColor,
+		TextBackground: textBackground,
+		TextPosition:   textPosition,
+	}, nil
+}
+
+// fitToSource lowers the requested size of a random image until the limits that depend on the source are met.
+// Random routes pick a different image every time, so a URL must not be rejected only because of the image it got.
+// Requests for an id or seed always get the same image and are checked as they are.
+func (p *ImageHandler) fitToSource(settings ImageSettings, info ImageInfo) ImageSettings {
+	sourceWidth, sourceHeight := orientedSourceSize(settings, info)
+	if sourceWidth == 0 || sourceHeight == 0 {
+		return settings
 	}
 
-	c.Set(fiber.HeaderContentType, MIMEImageJpeg)
-	jpeg.Encode(c, img, nil)
-	return c.SendStatus(fiber.StatusOK)
+	if p.settings.MaxUpscale > 0 {
+		if upscale := upscaleFactor(settings, sourceWidth, sourceHeight); upscale > p.settings.MaxUpscale {
+			factor := p.settings.MaxUpscale / upscale
+			settings.Width = max(1, int(float64(settings.Width)*factor))
+			if settings.Height > 0 {
+				settings.Height = max(1, int(float64(settings.Height)*factor))
+			}
+		}
+	}
+
+	if settings.Height == 0 {
+		// The height follows the aspect ratio of the source, so it decides whether the width fits
+		width := min(settings.Width, p.settings.MaxHeight*sourceWidth/sourceHeight)
+		if p.settings.MaxPixels > 0 {
+			width = min(width, int(math.Sqrt(float64(p.settings.MaxPixels)*float64(sourceWidth)/float64(sourceHeight))))
+			for width > 1 && width*heightForWidth(width, sourceWidth, sourceHeight) > p.settings.MaxPixels {
+				width--
+			}
+		}
+		settings.Width = max(1, width)
+	}
+
+	return settings
+}
+
+// checkOutputSize rejects settings that would produce an image with more pixels than allowed,
+// or that would enlarge the source image by more than the maximum upscale factor
+func (p *ImageHandler) checkOutputSize(settings ImageSettings, info ImageInfo) *RequestError {
+	sourceWidth, sourceHeight := orientedSourceSize(settings, info)
+
+	width, height := settings.Width, settings.Height
+	if height == 0 && sourceWidth > 0 {
+		height = heightForWidth(width, sourceWidth, sourceHeight)
+		if height > p.settings.MaxHeight {
+			return invalidParameter("width", "Requested width results in a height of %d, the maximum is %d", height, p.settings.MaxHeight)
+		}
+	}
+
+	if p.settings.MaxPixels > 0 && width*height > p.settings.MaxPixels {
+		return invalidParameter("height", "Requested size of %dx%d exceeds the maximum of %d pixels", width, height, p.settings.MaxPixels)
+	}
+
+	if p.settings.MaxUpscale <= 0 || sourceWidth == 0 || sourceHeight == 0 {
+		return nil
+	}
+
+	if upscale := upscaleFactor(settings, sourceWidth, sourceHeight); upscale > p.settings.MaxUpscale {
+		return invalidParameter("width", "Requested size would enlarge the image %.2f times, the maximum is %g", upscale, p.settings.MaxUpscale)
+	}
+
+	return nil
+}
+
+// orientedSourceSize returns the size of the source image after the rotation of settings, 0 when it is unknown
+func orientedSourceSize(settings ImageSettings, info ImageInfo) (width, height int) {
+	if settings.Rotate == 90 || settings.Rotate == 270 {
+		return info.Height, info.Width
+	}
+	return info.Width, info.Height
+}
+
+// heightForWidth returns the height of a sourceWidth x sourceHeight image resized to width
+func heightForWidth(width, sourceWidth, sourceHeight int) int {
+	return max(1, int(math.Round(float64(sourceHeight)*float64(width)/float64(sourceWidth))))
+}
+
+// upscaleFactor returns how many times settings enlarge a sourceWidth x sourceHeight source.
+// fit and pad never enlarge the source, every other mode scales it to cover the requested size.
+func upscaleFactor(settings ImageSettings, sourceWidth, sourceHeight int) float64 {
+	if settings.Height == 0 {
+		return float64(settings.Width) / float64(sourceWidth)
+	}
+	if settings.ResizeMode == "fill" || settings.ResizeMode == "none" {
+		return math.Max(float64(settings.Width)/float64(sourceWidth), float64(settings.Height)/float64(sourceHeight))
+	}
+	return 1
+}
+
+// queryFloatInRange parses the named query parameter as a float and checks that it is within [low, high]
+func queryFloatInRange(c fiber.Ctx, name string, defaultValue, low, high float64) (float64, *RequestError) {
+	raw := c.Query(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(value >= low && value <= high) {
+		return 0, invalidParameter(name, "Invalid %s parameter. Must be between %g and %g", name, low, high)
+	}
+
+	return value, nil
+}
+
+// effectiveDpr lowers dpr so that the scaled size stays within -maxWidth, -maxHeight and -maxPixels.
+// When only the width is requested, the height is the one checkOutputSize derives from the source.
+func (p *ImageHandler) effectiveDpr(dpr float64, width, height, sourceWidth, sourceHeight int) float64 {
+	scaledSize := func(dpr float64) (int, int) {
+		scaledWidth := scaleByDpr(width, dpr)
+		if height == 0 && sourceWidth > 0 && sourceHeight > 0 {
+			return scaledWidth, heightForWidth(scaledWidth, sourceWidth, sourceHeight)
+		}
+		return scaledWidth, scaleByDpr(height, dpr)
+	}
+
+	width1, height1 := scaledSize(1)
+	if width1 > 0 && p.settings.MaxWidth > 0 {
+		dpr = math.Min(dpr, float64(p.settings.MaxWidth)/float64(width1))
+	}
+	if height1 > 0 && p.settings.MaxHeight > 0 {
+		dpr = math.Min(dpr, float64(p.settings.MaxHeight)/float64(height1))
+	}
+	if width1 > 0 && height1 > 0 && p.settings.MaxPixels > 0 {
+		dpr = math.Min(dpr, math.Sqrt(float64(p.settings.MaxPixels)/(float64(width1)*float64(height1))))
+	}
+
+	// Rounding the scaled size can still take it a pixel over a limit
+	step := 1 / float64(max(width1, height1, 1))
+	for dpr > 1 && !p.withinOutputLimits(scaledSize(dpr)) {
+		dpr -= step
+	}
+
+	return math.Max(1, dpr)
+}
+
+// withinOutputLimits reports whether an image of width x height is within -maxWidth, -maxHeight and -maxPixels
+func (p *ImageHandler) withinOutputLimits(width, height int) bool {
+	return (p.settings.MaxWidth <= 0 || width <= p.settings.MaxWidth) &&
+		(p.settings.MaxHeight <= 0 || height <= p.settings.MaxHeight) &&
+		(p.settings.MaxPixels <= 0 || width*height <= p.settings.MaxPixels)
+}
+
+func scaleByDpr(value int, dpr float64) int {
+	return int(math.Round(float64(value) * dpr))
 }
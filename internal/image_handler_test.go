@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// testServiceSettings returns the defaults of the command line flags that matter to the handler
+func testServiceSettings() ServiceSettings {
+	return ServiceSettings{
+		MaxWidth:           4096,
+		MaxHeight:          4096,
+		MaxPixels:          16 * 1024 * 1024,
+		MaxBlur:            50,
+		MaxUpscale:         4,
+		ResizeFilter:       FilterCatmullRom,
+		RandomCacheControl: "no-store",
+		StableCacheControl: "public, max-age=31536000, immutable",
+		CaptionSize:        24,
+		CaptionColor:       "ffffff",
+		CaptionBackground:  "00000080",
+		CaptionPosition:    CaptionBottom,
+	}
+}
+
+func newTestHandler(t testing.TB, settings ServiceSettings, storage ImageStorageInterface) *ImageHandler {
+	t.Helper()
+
+	var picker ImagePickerInterface
+	if storage != nil {
+		picker = NewRandomImagePicker(storage)
+	}
+
+	handler, err := NewImageHandler(settings, storage, picker, NewTransformPool(1, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// newTestApp serves the image routes of handler
+func newTestApp(handler *ImageHandler) *fiber.App {
+	app := fiber.New()
+	methods := []string{fiber.MethodGet, fiber.MethodHead}
+	app.Add(methods, "/:width<int>/:height<int>", handler.HandleRequest)
+	app.Add(methods, "/id/:id/:width<int>", handler.HandleRequest)
+	app.Add(methods, "/id/:id/:width<int>/:height<int>", handler.HandleRequest)
+	app.Add(methods, "/seed/:seed/:width<int>/:height<int>", handler.HandleRequest)
+	return app
+}
+
+func testRequest(t testing.TB, app *fiber.App, path string, header http.Header) *http.Response {
+	t.Helper()
+	return testRequestMethod(t, app, fiber.MethodGet, path, header)
+}
+
+func testRequestMethod(t testing.TB, app *fiber.App, method string, path string, header http.Header) *http.Response {
+	t.Helper()
+
+	request := httptest.NewRequest(method, path, nil)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	// Large images take well over the default second to encode under the race detector
+	response, err := app.Test(request, fiber.TestConfig{Timeout: 30 * time.Second, FailOnTimeout: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestFitToSource(t *testing.T) {
+	handler := newTestHandler(t, ServiceSettings{
+		MaxWidth:   4096,
+		MaxHeight:  4096,
+		MaxPixels:  16 * 1024 * 1024,
+		MaxUpscale: 4,
+	}, nil)
+
+	large := ImageInfo{Width: 1600, Height: 1200}
+	small := ImageInfo{Width: 300, Height: 200}
+	panorama := ImageInfo{Width: 400, Height: 4000}
+
+	tests := []struct {
+		name       string
+		settings   ImageSettings
+		info       ImageInfo
+		wantWidth  int
+		wantHeight int
+	}{
+		{"fill within limits", ImageSettings{Width: 2000, Height: 1500, ResizeMode: "fill"}, large, 2000, 1500},
+		{"fill over upscale", ImageSettings{Width: 2000, Height: 1500, ResizeMode: "fill"}, small, 1066, 800},
+		{"fit never upscales", ImageSettings{Width: 2000, Height: 1500, ResizeMode: "fit"}, small, 2000, 1500},
+		{"width over upscale", ImageSettings{Width: 4000, ResizeMode: "fit"}, small, 1200, 0},
+		{"rotated source", ImageSettings{Width: 2000, Height: 1500, ResizeMode: "fill", Rotate: 90}, small, 800, 600},
+		{"width over height limit", ImageSettings{Width: 1000, ResizeMode: "fit"}, panorama, 409, 0},
+		{"unknown source size", ImageSettings{Width: 4000, ResizeMode: "fill", Height: 4000}, ImageInfo{}, 4000, 4000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := handler.fitToSource(test.settings, test.info)
+			if settings.Width != test.wantWidth || settings.Height != test.wantHeight {
+				t.Errorf("fitToSource() = %dx%d, want %dx%d", settings.Width, settings.Height, test.wantWidth, test.wantHeight)
+			}
+			if err := handler.checkOutputSize(settings, test.info); err != nil {
+				t.Errorf("checkOutputSize() after fitToSource() = %v", err.Message)
+			}
+		})
+	}
+}
+
+func TestFitToSourceAlwaysPasses(t *testing.T) {
+	handler := newTestHandler(t, ServiceSettings{
+		MaxWidth:   4096,
+		MaxHeight:  4096,
+		MaxPixels:  4 * 1024 * 1024,
+		MaxUpscale: 1.5,
+	}, nil)
+
+	sources := []ImageInfo{{Width: 1, Height: 1}, {Width: 7, Height: 4099}, {Width: 4099, Height: 7}, {Width: 333, Height: 777}, {Width: 6000, Height: 4000}}
+	for _, info := range sources {
+		for _, mode := range []string{"fit", "fill", "pad", "none"} {
+			for _, width := range []int{1, 17, 1000, 2047, 4096} {
+				for _, height := range []int{0, 1, 999, 2048} {
+					if width*height > handler.settings.MaxPixels {
+						continue
+					}
+					settings := handler.fitToSource(ImageSettings{Width: width, Height: height, ResizeMode: mode}, info)
+					if err := handler.checkOutputSize(settings, info); err != nil {
+						t.Errorf("%dx%d %s from %dx%d fitted to %dx%d: %s", width, height, mode,
+							info.Width, info.Height, settings.Width, settings.Height, err.Message)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestValidators(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	storage := newTestStorage(t, dir)
+	app := newTestApp(newTestHandler(t, testServiceSettings(), storage))
+
+	response := testRequest(t, app, "/id/a.jpg/200/150", nil)
+	etag := response.Header.Get(fiber.HeaderETag)
+	if response.StatusCode != fiber.StatusOK || etag == "" || response.Header.Get(fiber.HeaderLastModified) == "" {
+		t.Fatalf("GET = %d with ETag %q and Last-Modified %q, want 200 with both", response.StatusCode,
+			etag, response.Header.Get(fiber.HeaderLastModified))
+	}
+
+	response = testRequest(t, app, "/id/a.jpg/200/150", http.Header{fiber.HeaderIfNoneMatch: {etag}})
+	if response.StatusCode != fiber.StatusNotModified || response.Header.Get(fiber.HeaderETag) != etag {
+		t.Errorf("conditional GET = %d with ETag %q, want 304 with %q", response.StatusCode, response.Header.Get(fiber.HeaderETag), etag)
+	}
+
+	response = testRequest(t, app, "/200/150", nil)
+	if response.StatusCode != fiber.StatusOK || response.Header.Get(fiber.HeaderETag) != "" {
+		t.Errorf("random GET = %d with ETag %q, want 200 without one", response.StatusCode, response.Header.Get(fiber.HeaderETag))
+	}
+
+	// A failing transform must not be answered with the validators of the image
+	storage.imageTransformer = failingTransformer{}
+	response = testRequest(t, app, "/id/a.jpg/100/75?grayscale=true", nil)
+	if response.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("GET with a failing transform = %d, want 500", response.StatusCode)
+	}
+	for _, header := range []string{fiber.HeaderETag, fiber.HeaderLastModified, fiber.HeaderCacheControl} {
+		if value := response.Header.Get(header); value != "" {
+			t.Errorf("error response has %s %q", header, value)
+		}
+	}
+}
+
+func TestETagChangesWithServerSettings(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	storage := newTestStorage(t, dir)
+
+	watermarkFile := filepath.Join(t.TempDir(), "watermark.png")
+	writeWatermark := func(size int) {
+		file, err := os.Create(watermarkFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := png.Encode(file, image.NewNRGBA(image.Rect(0, 0, size, size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeWatermark(8)
+
+	etag := func(settings ServiceSettings) string {
+		response := testRequest(t, newTestApp(newTestHandler(t, settings, storage)), "/id/a.jpg/200/150", nil)
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("GET = %d, want 200", response.StatusCode)
+		}
+		return response.Header.Get(fiber.HeaderETag)
+	}
+
+	settings := testServiceSettings()
+	settings.WatermarkFile = watermarkFile
+	settings.WatermarkPosition = WatermarkBottomRight
+	settings.WatermarkScale = 0.2
+	settings.WatermarkOpacity = 0.5
+	original := etag(settings)
+
+	if again := etag(settings); again != original {
+		t.Fatalf("ETag changed from %q to %q without any change", original, again)
+	}
+
+	changes := map[string]func(*ServiceSettings){
+		"watermark position": func(s *ServiceSettings) { s.WatermarkPosition = WatermarkTopLeft },
+		"watermark margin":   func(s *ServiceSettings) { s.WatermarkMargin = 4 },
+		"watermark scale":    func(s *ServiceSettings) { s.WatermarkScale = 0.3 },
+		"watermark opacity":  func(s *ServiceSettings) { s.WatermarkOpacity = 0.8 },
+		"skin tone":          func(s *ServiceSettings) { s.SmartCropSkinTone = true },
+		"resize filter":      func(s *ServiceSettings) { s.ResizeFilter = FilterLanczos },
+	}
+	for name, change := range changes {
+		changed := settings
+		change(&changed)
+		if etag(changed) == original {
+			t.Errorf("ETag did not change with the %s", name)
+		}
+	}
+
+	writeWatermark(16)
+	if etag(settings) == original {
+		t.Errorf("ETag did not change with the content of the watermark file")
+	}
+}
+
+func TestBusyServerRejectsRequests(t *testing.T) {
+	tests := []struct {
+		name           string
+		queueSize      int
+		queueTimeout   time.Duration
+		wantRetryAfter string
+	}{
+		{"queue full", 0, 3 * time.Second, "3"},
+		{"queue timeout", 1, 50 * time.Millisecond, "1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+
+			transformer, err := NewImageTransfomer(ServiceSettings{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool := NewTransformPool(1, test.queueSize, test.queueTimeout)
+			storage, err := NewImageStorage(ImageStoreTypeLocal, transformer, dir, 0, "", nil, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler, err := NewImageHandler(testServiceSettings(), storage, NewRandomImagePicker(storage), pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer occupy(t, pool)()
+
+			response := testRequest(t, newTestApp(handler), "/id/a.jpg/200/150", nil)
+			if response.StatusCode != fiber.StatusServiceUnavailable {
+				t.Errorf("GET while busy = %d, want 503", response.StatusCode)
+			}
+			if retryAfter := response.Header.Get(fiber.HeaderRetryAfter); retryAfter != test.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", retryAfter, test.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestEffectiveDpr(t *testing.T) {
+	handler := newTestHandler(t, ServiceSettings{MaxWidth: 4096, MaxHeight: 4096, MaxPixels: 8000000}, nil)
+
+	tests := []struct {
+		name                      string
+		dpr                       float64
+		width, height             int
+		sourceWidth, sourceHeight int
+		wantWidth, wantHeight     int
+	}{
+		{"within limits", 2, 800, 600, 0, 0, 1600, 1200},
+		{"over the width", 4, 2000, 100, 0, 0, 4096, 205},
+		{"over the pixels", 2, 2000, 2000, 0, 0, 2828, 2828},
+		{"width only over the derived height", 2, 1000, 0, 300, 1200, 1024, 4096},
+		{"width only over the pixels", 4, 1000, 0, 400, 300, 3265, 2449},
+		{"never below 1", 2, 5000, 5000, 0, 0, 5000, 5000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dpr := handler.effectiveDpr(test.dpr, test.width, test.height, test.sourceWidth, test.sourceHeight)
+			width, height := scaleByDpr(test.width, dpr), scaleByDpr(test.height, dpr)
+			if test.height == 0 {
+				height = heightForWidth(width, test.sourceWidth, test.sourceHeight)
+			}
+			if width != test.wantWidth || height != test.wantHeight {
+				t.Errorf("effectiveDpr() = %g, scaling to %dx%d, want %dx%d", dpr, width, height, test.wantWidth, test.wantHeight)
+			}
+		})
+	}
+}
+
+func TestDprIsClampedToLimits(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "wide.jpg"), 400, 300)
+	writeTestJpeg(t, filepath.Join(dir, "tall.jpg"), 500, 2000)
+
+	settings := testServiceSettings()
+	settings.MaxPixels = 8000000
+	app := newTestApp(newTestHandler(t, settings, newTestStorage(t, dir)))
+
+	for _, path := range []string{"/id/wide.jpg/2000/2000?dpr=2", "/id/tall.jpg/400?dpr=4"} {
+		if response := testRequest(t, app, path, nil); response.StatusCode != fiber.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, response.StatusCode)
+		}
+	}
+}
+
+func TestLastModifiedFollowsServerSettings(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	sourceTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "a.jpg"), sourceTime, sourceTime); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newTestHandler(t, testServiceSettings(), newTestStorage(t, dir))
+	app := newTestApp(handler)
+
+	tests := []struct {
+		name             string
+		settingsTime     time.Time
+		ifModifiedSince  time.Time
+		wantLastModified time.Time
+		wantStatus       int
+	}{
+		{"source changed last", sourceTime.AddDate(-1, 0, 0), time.Time{}, sourceTime, fiber.StatusOK},
+		{"settings changed last", sourceTime.AddDate(1, 0, 0), time.Time{}, sourceTime.AddDate(1, 0, 0), fiber.StatusOK},
+		{"cached before the settings changed", sourceTime.AddDate(1, 0, 0), sourceTime, sourceTime.AddDate(1, 0, 0), fiber.StatusOK},
+		{"cached after the settings changed", sourceTime.AddDate(1, 0, 0), sourceTime.AddDate(1, 0, 0), sourceTime.AddDate(1, 0, 0), fiber.StatusNotModified},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler.settingsTime = test.settingsTime
+
+			header := http.Header{}
+			if !test.ifModifiedSince.IsZero() {
+				header.Set(fiber.HeaderIfModifiedSince, test.ifModifiedSince.Format(http.TimeFormat))
+			}
+
+			response := testRequest(t, app, "/id/a.jpg/200/150", header)
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("GET = %d, want %d", response.StatusCode, test.wantStatus)
+			}
+			if lastModified := response.Header.Get(fiber.HeaderLastModified); lastModified != test.wantLastModified.Format(http.TimeFormat) {
+				t.Errorf("Last-Modified = %q, want %q", lastModified, test.wantLastModified.Format(http.TimeFormat))
+			}
+		})
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	app := newTestApp(newTestHandler(t, testServiceSettings(), newTestStorage(t, dir)))
+
+	headers := []string{
+		fiber.HeaderContentType,
+		fiber.HeaderContentLength,
+		fiber.HeaderETag,
+		fiber.HeaderLastModified,
+		fiber.HeaderCacheControl,
+		HeaderImageWidth,
+		HeaderImageHeight,
+	}
+
+	for _, path := range []string{"/id/a.jpg/200/150?grayscale=true", "/seed/x/100/100?resizemode=fill", "/200/100"} {
+		t.Run(path, func(t *testing.T) {
+			get := testRequestMethod(t, app, fiber.MethodGet, path, nil)
+			body, err := io.ReadAll(get.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if get.StatusCode != fiber.StatusOK {
+				t.Fatalf("GET = %d, want 200", get.StatusCode)
+			}
+			if contentLength := get.Header.Get(fiber.HeaderContentLength); contentLength != strconv.Itoa(len(body)) {
+				t.Errorf("GET Content-Length = %q, body is %d bytes", contentLength, len(body))
+			}
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if get.Header.Get(HeaderImageWidth) != strconv.Itoa(config.Width) || get.Header.Get(HeaderImageHeight) != strconv.Itoa(config.Height) {
+				t.Errorf("GET %s x %s = %q x %q, image is %dx%d", HeaderImageWidth, HeaderImageHeight,
+					get.Header.Get(HeaderImageWidth), get.Header.Get(HeaderImageHeight), config.Width, config.Height)
+			}
+
+			head := testRequestMethod(t, app, fiber.MethodHead, path, nil)
+			if head.StatusCode != fiber.StatusOK {
+				t.Fatalf("HEAD = %d, want 200", head.StatusCode)
+			}
+			if body, _ := io.ReadAll(head.Body); len(body) != 0 {
+				t.Errorf("HEAD sent a body of %d bytes", len(body))
+			}
+			for _, header := range headers {
+				if head.Header.Get(header) != get.Header.Get(header) {
+					t.Errorf("HEAD %s = %q, GET sent %q", header, head.Header.Get(header), get.Header.Get(header))
+				}
+			}
+		})
+	}
+}
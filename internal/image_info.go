@@ -0,0 +1,14 @@
+package internal
+
+import "time"
+
+// ImageInfo describes a stored image without decoding it
+type ImageInfo struct {
+	Key       string // Path of the image relative to the image directory, separated by /
+	Folder    string // Name of the directory the image is stored in
+	Size      int64
+	Width     int // Width of the source in pixels, 0 when it could not be read
+	Height    int // Height of the source in pixels, 0 when it could not be read
+	ModTime   time.Time
+	DateTaken time.Time // From EXIF when available, otherwise the modification time
+}
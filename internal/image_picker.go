@@ -1,16 +1,23 @@
 package internal
 
 import (
+	"hash/fnv"
 	"math/rand"
+	"slices"
 )
 
 type ImagePickerInterface interface {
 	Image() (imageKey string)
+
+	// ImageForSeed always returns the same image for the same seed, as long as the set of images does not change
+	ImageForSeed(seed string) (imageKey string)
 }
 
 func NewRandomImagePicker(storage ImageStorageInterface) *RandomImagePicker {
 
 	keys := storage.Keys()
+	// Keys come out of the store in no particular order. Sorting them keeps seeds stable across restarts.
+	slices.Sort(keys)
 	return &RandomImagePicker{
 		imageStorage: storage,
 		keys:         keys,
@@ -28,3 +35,12 @@ func (r *RandomImagePicker) Image() string {
 	}
 	return r.keys[rand.Intn(len(r.keys))]
 }
+
+func (r *RandomImagePicker) ImageForSeed(seed string) string {
+	if len(r.keys) == 0 {
+		return ""
+	}
+	hasher := fnv.New64a()
+	hasher.Write([]byte(seed))
+	return r.keys[hasher.Sum64()%uint64(len(r.keys))]
+}
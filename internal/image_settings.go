@@ -1,9 +1,154 @@
 package internal
 
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
 type ImageSettings struct {
-	Width      int
-	Height     int
-	Blur       float64
-	Grayscale  bool
-	ResizeMode string
+	Width       int
+	Height      int
+	Blur        float64
+	Grayscale   bool
+	ResizeMode  string
+	Gravity     string
+	Rotate      int
+	Flip        string
+	Brightness  float64
+	Contrast    float64
+	Saturation  float64
+	Gamma       float64
+	Hue         float64
+	Sepia       bool
+	Duotone     []color.NRGBA // Dark and light color, nil when disabled
+	Pixelate    int
+	Vignette    float64
+	Sharpen     float64
+	AutoSharpen bool   // Sharpen based on how much the image was downscaled
+	Filter      string // Resampling filter used when resizing
+	Watermark   bool   // Composite the server's watermark onto the image
+	Fingerprint string // Hash of the server settings that change the image, such as the watermark
+
+	PadBackground color.NRGBA // Color around the image in pad mode
+	PadBlur       bool        // Use a blurred copy of the image around it in pad mode instead of PadBackground
+	BorderWidth   int
+	BorderColor   color.NRGBA
+
+	Radius int    // Radius of the rounded corners in pixels
+	Mask   string // Shape to cut the image into
+
+	Text           string // Caption with the placeholders already expanded
+	TextSize       float64
+	TextColor      color.NRGBA
+	TextBackground color.NRGBA
+	TextPosition   string
+}
+
+// hasAdjustments reports whether the settings change the image beyond resizing it
+func (s ImageSettings) hasAdjustments() bool {
+	return s.Grayscale || s.Blur != 0 || s.Rotate != 0 || s.Flip != "" ||
+		s.Brightness != 0 || s.Contrast != 0 || s.Saturation != 0 || s.Hue != 0 || s.hasGamma() ||
+		s.Sepia || len(s.Duotone) == 2 || s.Pixelate > 1 || s.Vignette > 0 ||
+		s.Sharpen > 0 || s.Watermark || s.Text != "" || s.BorderWidth > 0 || s.hasTransparency()
+}
+
+// hasTransparency reports whether the transformed image has transparent areas and needs a format with alpha
+func (s ImageSettings) hasTransparency() bool {
+	return s.Radius > 0 || s.Mask != ""
+}
+
+// mimeType returns the format the transformed image should be encoded in
+func (s ImageSettings) mimeType() string {
+	if s.hasTransparency() {
+		return MIMEImagePng
+	}
+	return MIMEImageJpeg
+}
+
+// hasGamma reports whether a gamma correction was requested. Both 0 (unset) and 1 leave the image unchanged.
+func (s ImageSettings) hasGamma() bool {
+	return s.Gamma != 0 && s.Gamma != 1
+}
+
+// cacheKey describes the image that imageKey transformed with these settings produces. Settings that
+// produce the same image give the same key.
+func (s ImageSettings) cacheKey(imageKey string) string {
+	return fmt.Sprintf("n:%s_w:%d_h:%d_b:%f_g:%t_m:%s_gr:%s_r:%d_f:%s_br:%f_c:%f_s:%f_ga:%f_hu:%f_se:%t_dt:%v_px:%d_v:%f_sh:%f_as:%t_fl:%s_wm:%t_t:%q_ts:%f_tc:%v_tb:%v_tp:%s_bg:%v_bgb:%t_bw:%d_bc:%v_ra:%d_mk:%s_sv:%s%s", imageKey,
+		s.Width,
+		s.Height,
+		s.Blur,
+		s.Grayscale,
+		s.ResizeMode,
+		s.Gravity,
+		s.Rotate,
+		s.Flip,
+		s.Brightness,
+		s.Contrast,
+		s.Saturation,
+		s.Gamma,
+		s.Hue,
+		s.Sepia,
+		s.Duotone,
+		s.Pixelate,
+		s.Vignette,
+		s.Sharpen,
+		s.AutoSharpen,
+		s.Filter,
+		s.Watermark,
+		s.Text,
+		s.TextSize,
+		s.TextColor,
+		s.TextBackground,
+		s.TextPosition,
+		s.PadBackground,
+		s.PadBlur,
+		s.BorderWidth,
+		s.BorderColor,
+		s.Radius,
+		s.Mask,
+		s.Fingerprint,
+		fileExtFromMimeType(s.mimeType()),
+	)
+}
+
+// sizeHint tells the decoder how large the decoded image needs to be for the output to keep all its detail
+type sizeHint struct {
+	Width  int  // Required width in pixels, 0 when any width will do
+	Height int  // Required height in pixels, 0 when any height will do
+	Cover  bool // Both dimensions must be met. Otherwise meeting either one is enough, like fit mode.
+}
+
+// sizeHint returns the decode size needed for these settings, in the orientation of the source image
+func (s ImageSettings) sizeHint() sizeHint {
+	width, height := s.Width, s.Height
+	if s.Rotate == 90 || s.Rotate == 270 {
+		width, height = height, width
+	}
+
+	return sizeHint{
+		Width:  width,
+		Height: height,
+		Cover:  s.Height == 0 || (s.ResizeMode != "fit" && s.ResizeMode != "pad"),
+	}
+}
+
+// scale returns the smallest fraction of a width x height source that satisfies the hint.
+// A value of 1 or more means the full resolution is needed.
+func (h sizeHint) scale(width, height int) float64 {
+	if width <= 0 || height <= 0 || (h.Width <= 0 && h.Height <= 0) {
+		return 1
+	}
+
+	scaleX, scaleY := float64(h.Width)/float64(width), float64(h.Height)/float64(height)
+	if h.Width <= 0 {
+		return scaleY
+	}
+	if h.Height <= 0 {
+		return scaleX
+	}
+	if h.Cover {
+		return math.Max(scaleX, scaleY)
+	}
+	return math.Min(scaleX, scaleY)
 }
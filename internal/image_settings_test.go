@@ -0,0 +1,50 @@
+package internal
+
+import "testing"
+
+func TestSizeHintScale(t *testing.T) {
+	tests := []struct {
+		name          string
+		hint          sizeHint
+		width, height int
+		want          float64
+	}{
+		{"no hint", sizeHint{}, 1600, 1200, 1},
+		{"unknown source", sizeHint{Width: 400, Height: 300}, 0, 0, 1},
+		{"width only", sizeHint{Width: 400}, 1600, 1200, 0.25},
+		{"height only", sizeHint{Height: 600}, 1600, 1200, 0.5},
+		{"fit takes the smaller scale", sizeHint{Width: 400, Height: 600}, 1600, 1200, 0.25},
+		{"cover takes the larger scale", sizeHint{Width: 400, Height: 600, Cover: true}, 1600, 1200, 0.5},
+		{"enlarging", sizeHint{Width: 3200, Height: 2400}, 1600, 1200, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.hint.scale(test.width, test.height); got != test.want {
+				t.Errorf("scale(%d, %d) = %g, want %g", test.width, test.height, got, test.want)
+			}
+		})
+	}
+}
+
+func TestImageSettingsSizeHint(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings ImageSettings
+		want     sizeHint
+	}{
+		{"fit", ImageSettings{Width: 400, Height: 300, ResizeMode: "fit"}, sizeHint{Width: 400, Height: 300}},
+		{"pad", ImageSettings{Width: 400, Height: 300, ResizeMode: "pad"}, sizeHint{Width: 400, Height: 300}},
+		{"fill", ImageSettings{Width: 400, Height: 300, ResizeMode: "fill"}, sizeHint{Width: 400, Height: 300, Cover: true}},
+		{"width only", ImageSettings{Width: 400, ResizeMode: "fit"}, sizeHint{Width: 400, Cover: true}},
+		{"rotated", ImageSettings{Width: 400, Height: 300, ResizeMode: "fill", Rotate: 90}, sizeHint{Width: 300, Height: 400, Cover: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.settings.sizeHint(); got != test.want {
+				t.Errorf("sizeHint() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
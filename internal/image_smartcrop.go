@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"image"
+	"math"
+
+	"github.com/nao1215/imaging"
+)
+
+const (
+	// smartCropAnalysisSize is the longest edge of the downscaled copy used to score crop windows
+	smartCropAnalysisSize = 256
+
+	// smartCropSkinBonus is the energy added to a pixel that looks like skin
+	smartCropSkinBonus = 128
+)
+
+// smartCropRect returns the region of img with the same aspect ratio as width x height
+// that contains the most detail. Detail is measured by edge density on a downscaled
+// copy of the image and, when skinTone is set, by the number of skin colored pixels.
+//
+// The result only depends on the pixels of img, so the same input always yields the same crop.
+func smartCropRect(img image.Image, width, height int, skinTone bool) image.Rectangle {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || srcWidth == 0 || srcHeight == 0 {
+		return bounds
+	}
+
+	cropWidth, cropHeight := srcWidth, srcHeight
+	if srcWidth*height > srcHeight*width {
+		cropWidth = clampInt(int(math.Round(float64(srcHeight)*float64(width)/float64(height))), 1, srcWidth)
+	} else {
+		cropHeight = clampInt(int(math.Round(float64(srcWidth)*float64(height)/float64(width))), 1, srcHeight)
+	}
+
+	if cropWidth == srcWidth && cropHeight == srcHeight {
+		return bounds
+	}
+
+	scale := math.Min(1, float64(smartCropAnalysisSize)/float64(max(srcWidth, srcHeight)))
+	analysisWidth := max(1, int(math.Round(float64(srcWidth)*scale)))
+	analysisHeight := max(1, int(math.Round(float64(srcHeight)*scale)))
+	windowWidth := clampInt(int(math.Round(float64(cropWidth)*scale)), 1, analysisWidth)
+	windowHeight := clampInt(int(math.Round(float64(cropHeight)*scale)), 1, analysisHeight)
+
+	small := imaging.Resize(img, analysisWidth, analysisHeight, imaging.Box)
+	table := summedAreaTable(energyMap(small, skinTone), analysisWidth, analysisHeight)
+
+	// Slide the window over the energy map and keep the densest position.
+	// Ties go to the position closest to the center so flat images crop like gravity=center.
+	centerX, centerY := (analysisWidth-windowWidth)/2, (analysisHeight-windowHeight)/2
+	bestX, bestY := centerX, centerY
+	bestScore := int64(-1)
+	bestDistance := 0
+	for y := 0; y <= analysisHeight-windowHeight; y++ {
+		for x := 0; x <= analysisWidth-windowWidth; x++ {
+			score := table.sum(x, y, x+windowWidth, y+windowHeight)
+			distance := absInt(x-centerX) + absInt(y-centerY)
+			if score > bestScore || (score == bestScore && distance < bestDistance) {
+				bestScore, bestDistance = score, distance
+				bestX, bestY = x, y
+			}
+		}
+	}
+
+	x0 := clampInt(int(math.Round(float64(bestX)/scale)), 0, srcWidth-cropWidth)
+	y0 := clampInt(int(math.Round(float64(bestY)/scale)), 0, srcHeight-cropHeight)
+
+	return image.Rect(
+		bounds.Min.X+x0,
+		bounds.Min.Y+y0,
+		bounds.Min.X+x0+cropWidth,
+		bounds.Min.Y+y0+cropHeight,
+	)
+}
+
+// energyMap scores every pixel of img by the strength of the luminance gradient around it
+func energyMap(img *image.NRGBA, skinTone bool) []int64 {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	luma := make([]int64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*img.Stride + x*4
+			r, g, b := int64(img.Pix[i]), int64(img.Pix[i+1]), int64(img.Pix[i+2])
+			luma[y*width+x] = (299*r + 587*g + 114*b) / 1000
+		}
+	}
+
+	energy := make([]int64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			left, right := luma[y*width+max(x-1, 0)], luma[y*width+min(x+1, width-1)]
+			up, down := luma[max(y-1, 0)*width+x], luma[min(y+1, height-1)*width+x]
+			e := absInt64(right-left) + absInt64(down-up)
+
+			if skinTone {
+				i := y*img.Stride + x*4
+				if isSkinTone(img.Pix[i], img.Pix[i+1], img.Pix[i+2]) {
+					e += smartCropSkinBonus
+				}
+			}
+			energy[y*width+x] = e
+		}
+	}
+
+	return energy
+}
+
+// isSkinTone reports whether the color falls in the common RGB skin tone range
+func isSkinTone(r, g, b uint8) bool {
+	maxC := max(r, g, b)
+	minC := min(r, g, b)
+	return r > 95 && g > 40 && b > 20 &&
+		maxC-minC > 15 &&
+		r > g && r > b &&
+		int(r)-int(g) > 15
+}
+
+type areaTable struct {
+	values []int64
+	stride int
+}
+
+func summedAreaTable(values []int64, width, height int) areaTable {
+	stride := width + 1
+	table := make([]int64, stride*(height+1))
+	for y := 0; y < height; y++ {
+		var row int64
+		for x := 0; x < width; x++ {
+			row += values[y*width+x]
+			table[(y+1)*stride+x+1] = table[y*stride+x+1] + row
+		}
+	}
+	return areaTable{values: table, stride: stride}
+}
+
+// sum returns the total of the values in the rectangle [x0, x1) x [y0, y1)
+func (t areaTable) sum(x0, y0, x1, y1 int) int64 {
+	return t.values[y1*t.stride+x1] - t.values[y0*t.stride+x1] - t.values[y1*t.stride+x0] + t.values[y0*t.stride+x0]
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// flatImage returns a width x height image of a single color
+func flatImage(width, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// withDetail draws a black and white checkerboard over r of img
+func withDetail(img *image.NRGBA, r image.Rectangle) *image.NRGBA {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.SetNRGBA(x, y, color.NRGBA{A: 255})
+			} else {
+				img.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+// withSkin fills r of img with a skin color
+func withSkin(img *image.NRGBA, r image.Rectangle) *image.NRGBA {
+	draw.Draw(img, r, image.NewUniform(color.NRGBA{R: 200, G: 140, B: 110, A: 255}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestSmartCropRect(t *testing.T) {
+	gray := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+
+	tests := []struct {
+		name          string
+		img           image.Image
+		width, height int
+		skinTone      bool
+		want          image.Rectangle
+	}{
+		{"flat crops the center horizontally", flatImage(400, 200, gray), 100, 100, false, image.Rect(100, 0, 300, 200)},
+		{"flat crops the center vertically", flatImage(400, 400, gray), 200, 100, false, image.Rect(0, 100, 400, 300)},
+		{"same aspect ratio", flatImage(400, 200, gray), 200, 100, false, image.Rect(0, 0, 400, 200)},
+		{"detail at the top", withDetail(flatImage(400, 400, gray), image.Rect(0, 0, 64, 64)), 200, 100, false, image.Rect(0, 0, 400, 200)},
+		{"detail on the left", withDetail(flatImage(400, 400, gray), image.Rect(0, 0, 64, 64)), 100, 200, false, image.Rect(0, 0, 200, 400)},
+		{"detail at the bottom right", withDetail(flatImage(800, 400, gray), image.Rect(720, 320, 800, 400)), 100, 100, false, image.Rect(400, 0, 800, 400)},
+		{"offset bounds", withDetail(flatImage(800, 400, gray), image.Rect(720, 320, 800, 400)).SubImage(image.Rect(400, 0, 800, 400)), 100, 200, false, image.Rect(600, 0, 800, 400)},
+		{"skin tone ignored", withSkin(flatImage(400, 200, gray), image.Rect(0, 0, 200, 200)), 100, 100, false, image.Rect(100, 0, 300, 200)},
+		{"skin tone preferred", withSkin(flatImage(400, 200, gray), image.Rect(0, 0, 200, 200)), 100, 100, true, image.Rect(0, 0, 200, 200)},
+		{"no size", flatImage(400, 200, gray), 0, 100, false, image.Rect(0, 0, 400, 200)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := smartCropRect(test.img, test.width, test.height, test.skinTone); got != test.want {
+				t.Errorf("smartCropRect() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// Crops are cached, so the same image and size must always give the same crop
+func TestSmartCropRectDeterministic(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 640, 480))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(seed >> 24)
+	}
+
+	for _, skinTone := range []bool{false, true} {
+		want := smartCropRect(img, 300, 300, skinTone)
+		for range 10 {
+			if got := smartCropRect(img, 300, 300, skinTone); got != want {
+				t.Fatalf("smartCropRect() = %v, then %v for the same image", want, got)
+			}
+		}
+	}
+}
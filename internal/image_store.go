@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"iter"
@@ -10,16 +11,28 @@ import (
 type ImageStorageInterface interface {
 	Images() iter.Seq[string]
 
-	Image(key string) (image.Image, error)
+	Image(ctx context.Context, key string) (image.Image, error)
 
-	ImageWithTransform(key string, settings ImageSettings) (image.Image, error)
+	ImageWithTransform(ctx context.Context, key string, settings ImageSettings) (image.Image, error)
+
+	// ImageData returns the file stored under key as it is on disk
+	ImageData(key string) ([]byte, error)
+
+	// ImageDataWithTransform returns the image stored under key, transformed and encoded as settings.mimeType()
+	ImageDataWithTransform(ctx context.Context, key string, settings ImageSettings) ([]byte, error)
 
 	MimeType(key string) string
 
+	Info(key string) (ImageInfo, error)
+
+	ContentHash(key string) (string, error)
+
 	Contains(key string) bool
 
 	Add(key string, mimeType string, img image.Image) error
 
+	AddData(key string, data []byte) error
+
 	ImageCount() int
 
 	Keys() []string
@@ -29,7 +42,11 @@ type ImageStorageInterface interface {
 	Clear() error
 }
 
-func NewImageStorage(storageType string, imageTransformer ImageTransformerInterface, path string) (ImageStorageInterface, error) {
+// NewImageStorage creates a store for the images in path. Images with more than maxPixels pixels are
+// never decoded, and are moved to quarantineDir when loading if it is not empty. Decodes reserve their
+// memory against memoryBudget, which may be shared between stores. Images are decoded and transformed
+// on the workers of transformPool, or right away when it is nil.
+func NewImageStorage(storageType string, imageTransformer ImageTransformerInterface, path string, maxPixels int, quarantineDir string, memoryBudget *MemoryBudget, transformPool *TransformPool) (ImageStorageInterface, error) {
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, fmt.Errorf("directory does not exist: %s", path)
@@ -39,6 +56,10 @@ func NewImageStorage(storageType string, imageTransformer ImageTransformerInterf
 		diskStore := &ImageStorageDisk{
 			location:         path,
 			imageTransformer: imageTransformer,
+			maxPixels:        maxPixels,
+			quarantineDir:    quarantineDir,
+			memoryBudget:     memoryBudget,
+			transformPool:    transformPool,
 		}
 		err := diskStore.LoadImages()
 		return diskStore, err
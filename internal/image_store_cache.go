@@ -1,17 +1,24 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"image"
 	"iter"
 	"log/slog"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type ImageStoreCacheLocal struct {
 	imageStore ImageStorageInterface
 	cacheStore ImageStorageInterface
+	inflight   singleflight.Group // Transforms in progress, keyed by the cached file name
 }
 
 func NewImageCacheLocal(imageStore ImageStorageInterface, cacheStore ImageStorageInterface) (*ImageStoreCacheLocal, error) {
@@ -29,8 +36,8 @@ func (c *ImageStoreCacheLocal) Images() iter.Seq[string] {
 	return c.imageStore.Images()
 }
 
-func (c *ImageStoreCacheLocal) Image(key string) (image.Image, error) {
-	return c.imageStore.Image(key)
+func (c *ImageStoreCacheLocal) Image(ctx context.Context, key string) (image.Image, error) {
+	return c.imageStore.Image(ctx, key)
 }
 
 func (c *ImageStoreCacheLocal) Empty() bool {
@@ -58,6 +65,14 @@ func (c *ImageStoreCacheLocal) MimeType(key string) string {
 	return c.imageStore.MimeType(key)
 }
 
+func (c *ImageStoreCacheLocal) Info(key string) (ImageInfo, error) {
+	return c.imageStore.Info(key)
+}
+
+func (c *ImageStoreCacheLocal) ContentHash(key string) (string, error) {
+	return c.imageStore.ContentHash(key)
+}
+
 func (c *ImageStoreCacheLocal) Contains(key string) bool {
 	return c.imageStore.Contains(key)
 }
@@ -66,28 +81,93 @@ func (c *ImageStoreCacheLocal) Add(key string, mimeType string, img image.Image)
 	return c.imageStore.Add(key, mimeType, img)
 }
 
-func (c *ImageStoreCacheLocal) ImageWithTransform(key string, imageSettings ImageSettings) (image.Image, error) {
+func (c *ImageStoreCacheLocal) AddData(key string, data []byte) error {
+	return c.imageStore.AddData(key, data)
+}
+
+func (c *ImageStoreCacheLocal) ImageData(key string) ([]byte, error) {
+	return c.imageStore.ImageData(key)
+}
 
-	var targetMimeType = MIMEImageJpeg
+// ImageWithTransform decodes the cached rendition of key, transforming and caching it first on a miss
+func (c *ImageStoreCacheLocal) ImageWithTransform(ctx context.Context, key string, imageSettings ImageSettings) (image.Image, error) {
+	data, err := c.ImageDataWithTransform(ctx, key, imageSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// ImageDataWithTransform returns the cached rendition of key as it is stored on disk, so repeated
+// requests get the same bytes whether or not they hit the cache
+func (c *ImageStoreCacheLocal) ImageDataWithTransform(ctx context.Context, key string, imageSettings ImageSettings) ([]byte, error) {
+
+	var targetMimeType = imageSettings.mimeType()
 	fileEx := fileExtFromMimeType(targetMimeType)
-	cacheKey := fmt.Sprintf("n:%s_w:%d_h:%d_b:%f_g:%t_m:%s%s", key,
-		imageSettings.Width,
-		imageSettings.Height,
-		imageSettings.Blur,
-		imageSettings.Grayscale,
-		imageSettings.ResizeMode,
-		fileEx,
-	)
+	cacheKey := imageSettings.cacheKey(key)
 
 	hashedName := fmt.Sprintf("%s%s", hashString(cacheKey), fileEx)
-	if c.cacheStore.Contains(hashedName) {
+
+	_, span := tracer.Start(ctx, "cache.lookup", trace.WithAttributes(attribute.String("cache.file", hashedName)))
+	hit := c.cacheStore.Contains(hashedName)
+	span.SetAttributes(attribute.Bool("cache.hit", hit))
+
+	if hit {
 		slog.Debug("Cache hit", "key", key, "cacheKey", cacheKey)
-		return c.cacheStore.Image(hashedName)
+		cacheHits.Inc()
+		data, err := c.cacheStore.ImageData(hashedName)
+		endSpan(span, err)
+		return data, err
 	}
 
-	img, err := c.imageStore.Image(key)
-	c.cacheStore.Add(hashedName, targetMimeType, img)
-	return img, err
+	span.End()
+	cacheMisses.Inc()
+
+	for {
+		// Concurrent requests for the same rendition wait for the first one instead of repeating the transform.
+		// The transform runs with the context of that first request, and only that request takes a worker
+		// of the transform pool, as the image store waits for one once the group was joined.
+		results := c.inflight.DoChan(hashedName, func() (any, error) {
+			if c.cacheStore.Contains(hashedName) {
+				return c.cacheStore.ImageData(hashedName)
+			}
+
+			data, err := c.imageStore.ImageDataWithTransform(ctx, key, imageSettings)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := c.cacheStore.AddData(hashedName, data); err != nil {
+				slog.Warn("Failed to cache image", "key", key, "cacheKey", cacheKey, "error", err)
+			}
+			return data, nil
+		})
+
+		// A request that is canceled or times out stops waiting at once. The transform goes on for the
+		// others, unless it is the context of the request running it that is done.
+		var result singleflight.Result
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if result.Shared {
+			slog.Debug("Shared in-flight transform", "key", key, "cacheKey", cacheKey)
+
+			// The request that ran the transform went away. Try again unless this one is done too.
+			if isContextError(result.Err) && ctx.Err() == nil {
+				continue
+			}
+		}
+
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.([]byte), nil
+	}
 }
 
 func hashString(str string) string {
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCache creates a cache over a store of the images in imageDir that transforms on pool
+func newTestCache(t testing.TB, imageDir string, pool *TransformPool) *ImageStoreCacheLocal {
+	t.Helper()
+
+	transformer, err := NewImageTransfomer(ServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageStore, err := NewImageStorage(ImageStoreTypeLocal, transformer, imageDir, 0, "", nil, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheStore, err := NewImageStorage(ImageStoreTypeLocal, transformer, t.TempDir(), 0, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewImageCacheLocal(imageStore, cacheStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestCacheHitDoesNotWaitForWorker(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+
+	pool := NewTransformPool(1, 0, 0)
+	cache := newTestCache(t, dir, pool)
+
+	cached := ImageSettings{Width: 200, Height: 150, ResizeMode: "fit"}
+	first, err := cache.ImageDataWithTransform(context.Background(), "a.jpg", cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the only worker busy, as a cold request would
+	started, done := make(chan struct{}), make(chan struct{})
+	go pool.Do(context.Background(), func() error {
+		close(started)
+		<-done
+		return nil
+	})
+	<-started
+	defer close(done)
+
+	data, err := cache.ImageDataWithTransform(context.Background(), "a.jpg", cached)
+	if err != nil {
+		t.Fatalf("cache hit while the pool is busy: %v", err)
+	}
+	if !bytes.Equal(data, first) {
+		t.Errorf("cache hit returned different bytes than the miss that cached it")
+	}
+
+	_, err = cache.ImageDataWithTransform(context.Background(), "a.jpg", ImageSettings{Width: 100, Height: 75, ResizeMode: "fit"})
+	if err != ErrQueueFull {
+		t.Errorf("cache miss while the pool is busy: error = %v, want %v", err, ErrQueueFull)
+	}
+}
+
+// countingStore counts the calls made to a store. ImageDataWithTransform waits for proceed to be closed.
+type countingStore struct {
+	ImageStorageInterface
+	proceed    chan struct{}
+	lookups    atomic.Int32
+	transforms atomic.Int32
+	adds       atomic.Int32
+}
+
+func (s *countingStore) Contains(key string) bool {
+	s.lookups.Add(1)
+	return s.ImageStorageInterface.Contains(key)
+}
+
+func (s *countingStore) ImageDataWithTransform(ctx context.Context, key string, settings ImageSettings) ([]byte, error) {
+	s.transforms.Add(1)
+	<-s.proceed
+	return s.ImageStorageInterface.ImageDataWithTransform(ctx, key, settings)
+}
+
+func (s *countingStore) AddData(key string, data []byte) error {
+	s.adds.Add(1)
+	return s.ImageStorageInterface.AddData(key, data)
+}
+
+func TestConcurrentMissesShareTransform(t *testing.T) {
+	const requests = 8
+
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+
+	// With a single worker and no queue, every request taking a slot of its own would be rejected
+	cache := newTestCache(t, dir, NewTransformPool(1, 0, time.Second))
+	imageStore := &countingStore{ImageStorageInterface: cache.imageStore, proceed: make(chan struct{})}
+	cacheStore := &countingStore{ImageStorageInterface: cache.cacheStore}
+	cache.imageStore, cache.cacheStore = imageStore, cacheStore
+
+	settings := ImageSettings{Width: 200, Height: 150, ResizeMode: "fit"}
+	results := make([][]byte, requests)
+	errs := make([]error, requests)
+
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Go(func() {
+			results[i], errs[i] = cache.ImageDataWithTransform(context.Background(), "a.jpg", settings)
+		})
+	}
+
+	// Let every request look up the cache and join the transform of the first one
+	deadline := time.Now().Add(5 * time.Second)
+	for cacheStore.lookups.Load() < requests && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(imageStore.proceed)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if !bytes.Equal(results[i], results[0]) {
+			t.Errorf("request %d got different bytes", i)
+		}
+	}
+
+	if got := imageStore.transforms.Load(); got != 1 {
+		t.Errorf("transforms = %d, want 1", got)
+	}
+	if got := cacheStore.adds.Load(); got != 1 {
+		t.Errorf("AddData calls = %d, want 1", got)
+	}
+}
+
+func TestCanceledWaiterStopsWaiting(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+
+	cache := newTestCache(t, dir, NewTransformPool(1, 0, time.Second))
+	imageStore := &countingStore{ImageStorageInterface: cache.imageStore, proceed: make(chan struct{})}
+	cacheStore := &countingStore{ImageStorageInterface: cache.cacheStore}
+	cache.imageStore, cache.cacheStore = imageStore, cacheStore
+
+	settings := ImageSettings{Width: 200, Height: 150, ResizeMode: "fit"}
+
+	// The first request runs the transform, which waits for proceed
+	var first []byte
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		first, firstErr = cache.ImageDataWithTransform(context.Background(), "a.jpg", settings)
+	})
+	for imageStore.transforms.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second request joins it and gives up while the transform is still running
+	ctx, cancel := context.WithCancel(context.Background())
+	waiterErr := make(chan error, 1)
+	go func() {
+		_, err := cache.ImageDataWithTransform(ctx, "a.jpg", settings)
+		waiterErr <- err
+	}()
+	for cacheStore.lookups.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-waiterErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("canceled waiter error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled waiter still waits for the transform")
+	}
+
+	close(imageStore.proceed)
+	wg.Wait()
+	if firstErr != nil || len(first) == 0 {
+		t.Errorf("first request = %d bytes, error %v, want the image", len(first), firstErr)
+	}
+	if got := imageStore.transforms.Load(); got != 1 {
+		t.Errorf("transforms = %d, want 1", got)
+	}
+}
@@ -1,35 +1,76 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"iter"
 	"log/slog"
+	"math"
 	"mime"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gen2brain/jpegn"
 	"github.com/hashicorp/go-set/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// thumbnailAspectTolerance is how far, relative to the aspect ratio of the image, the EXIF thumbnail may differ from it
+const thumbnailAspectTolerance = 0.01
+
+// errImageTooLarge is returned when decoding an image would exceed the pixel budget of the store
+var errImageTooLarge = errors.New("image exceeds the pixel budget")
+
+// contentHash is the hash of a file's content along with the size and modification time it was computed for
+type contentHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// ImageStorageDisk serves images from a directory. It is safe for concurrent use.
 type ImageStorageDisk struct {
 	location         string
 	imageTransformer ImageTransformerInterface
+	mu               sync.RWMutex // Guards images and hashes
 	images           set.Set[string]
+	hashes           map[string]contentHash // Content hashes by key, computed on first use
+	maxPixels        int                    // Largest image, in pixels, the store will decode. 0 for no limit
+	quarantineDir    string                 // Where to move images over the pixel budget when loading, empty to leave them in place
+	memoryBudget     *MemoryBudget          // Memory reserved while images are decoded and transformed, nil for no limit
+	transformPool    *TransformPool         // Workers that decode and transform images, nil to run them on the calling goroutine
 }
 
 func (p *ImageStorageDisk) ImageCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.images.Size()
 }
 
 func (p *ImageStorageDisk) Empty() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.images.Empty()
 }
 
+// Clear deletes every file in the store. Temporary files of an Add that is still
+// encoding are removed as well, which makes that Add fail rather than leave a stray image.
 func (p *ImageStorageDisk) Clear() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	files, err := os.ReadDir(p.location)
 	if err != nil {
@@ -38,12 +79,14 @@ func (p *ImageStorageDisk) Clear() error {
 	}
 	for _, file := range files {
 		path := filepath.Join(p.location, file.Name())
-		if err := os.Remove(path); err != nil {
+		// The temporary file of a failed Add may already be gone
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 			slog.Error("Failed to delete file", "path", path, "err", err)
 			return err
 		}
 	}
 	p.images = *set.New[string](0)
+	p.hashes = nil
 	return nil
 }
 
@@ -52,88 +95,374 @@ func (p *ImageStorageDisk) MimeType(key string) string {
 	return mime.TypeByExtension(ext)
 }
 
+func (p *ImageStorageDisk) Info(key string) (ImageInfo, error) {
+	path := filepath.Join(p.location, key)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	info := ImageInfo{
+		Key:       key,
+		Folder:    filepath.Base(filepath.Dir(path)),
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime(),
+		DateTaken: stat.ModTime(),
+	}
+
+	if config, err := decodeConfig(file, p.MimeType(key)); err == nil {
+		info.Width, info.Height = config.Width, config.Height
+	} else {
+		slog.Debug("Failed to read image dimensions", "path", path, "err", err)
+	}
+
+	if p.MimeType(key) == MIMEImageJpeg {
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			if exif, err := readExif(file); err == nil {
+				if !exif.dateTaken.IsZero() {
+					info.DateTaken = exif.dateTaken
+				}
+			} else if err != errNoExif {
+				slog.Debug("Failed to read exif", "path", path, "err", err)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// ContentHash returns the hex encoded SHA-256 of the file stored under key. Hashes are remembered
+// until the size or modification time of the file changes.
+func (p *ImageStorageDisk) ContentHash(key string) (string, error) {
+	path := filepath.Join(p.location, key)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.RLock()
+	cached, ok := p.hashes[key]
+	p.mu.RUnlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.sum, nil
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	p.mu.Lock()
+	if p.hashes == nil {
+		p.hashes = make(map[string]contentHash)
+	}
+	p.hashes[key] = contentHash{size: stat.Size(), modTime: stat.ModTime(), sum: sum}
+	p.mu.Unlock()
+
+	return sum, nil
+}
+
 func (p *ImageStorageDisk) Keys() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.images.Slice()
 }
 
+// Images iterates over a snapshot of the keys taken when it is called, so the
+// caller can take its time without blocking writers
 func (p *ImageStorageDisk) Images() iter.Seq[string] {
-	return p.images.Items()
+	return slices.Values(p.Keys())
 }
 
 func (p *ImageStorageDisk) Add(key string, mimeType string, img image.Image) error {
+	data, err := encodeImage(context.Background(), img, mimeType)
+	if err != nil {
+		return err
+	}
+	return p.AddData(key, data)
+}
+
+// AddData writes data to a temporary file and renames it to key, so readers never see a partially written image
+func (p *ImageStorageDisk) AddData(key string, data []byte) error {
 
 	path := filepath.Join(p.location, key)
 
-	file, err := os.Create(path)
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
 
-	defer file.Close()
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
 
-	switch mimeType {
-	case MIMEImageJpeg:
-		err = jpeg.Encode(file, img, nil)
-	case MIMEImagePng:
-		err = png.Encode(file, img)
-	default:
-		err = fmt.Errorf("unsupported image format: %s", mimeType)
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
 
 	if err != nil {
 		return err
 	}
 
+	// Rename under the lock so Clear never sees a file that is missing from the set
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+
 	p.images.Insert(key)
 
 	return nil
 }
 
 func (p *ImageStorageDisk) Contains(key string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.images.Contains(key)
 }
 
-func (p *ImageStorageDisk) Image(key string) (image.Image, error) {
+func (p *ImageStorageDisk) ImageData(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(p.location, key))
+}
+
+// ImageDataWithTransform decodes, transforms and encodes the image on a worker of the transform pool.
+// It returns the error of the pool when no worker is available.
+func (p *ImageStorageDisk) ImageDataWithTransform(ctx context.Context, key string, settings ImageSettings) ([]byte, error) {
+	var data []byte
+	err := p.transformPool.Do(ctx, func() error {
+		img, release, err := p.transform(ctx, key, settings)
+		if err != nil {
+			return err
+		}
+		// The transformed image and the encoded bytes are both alive until encoding is done
+		defer release()
+
+		_, span := tracer.Start(ctx, "encode", trace.WithAttributes(attribute.String("image.mime_type", settings.mimeType())))
+		data, err = encodeImage(ctx, img, settings.mimeType())
+		span.SetAttributes(attribute.Int("image.bytes", len(data)))
+		endSpan(span, err)
+		return err
+	})
+	return data, err
+}
+
+func (p *ImageStorageDisk) Image(ctx context.Context, key string) (image.Image, error) {
+	img, _, release, err := p.decode(ctx, key, sizeHint{})
+	if err != nil {
+		return nil, err
+	}
+	release()
+	return img, nil
+}
+
+// decode reads the image stored under key. When hint needs less than the full resolution, JPEGs are
+// decoded from their embedded EXIF thumbnail if it is large enough, or scaled by 1/2, 1/4 or 1/8 while decoding.
+// sourceSize is the size of the stored image, which is larger than img when it was decoded at a reduced size.
+// Decoding stops with the error of ctx once it is done.
+//
+// The memory needed to decode the image and produce an output of the hinted size is reserved against the
+// memory budget before decoding. Call release once the image and anything made from it are no longer needed.
+func (p *ImageStorageDisk) decode(ctx context.Context, key string, hint sizeHint) (img image.Image, sourceSize image.Point, release func(), err error) {
 	path := filepath.Join(p.location, key)
 
+	ctx, span := tracer.Start(ctx, "decode", trace.WithAttributes(attribute.String("image.key", key)))
+	defer func() { endSpan(span, err) }()
+
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, image.Point{}, nil, err
 	}
 	defer file.Close()
 
-	var img image.Image
 	mimeType := p.MimeType(path)
 
-	switch mimeType {
-	case MIMEImageJpeg:
-		img, err = jpeg.Decode(file)
-	case MIMEImagePng:
-		img, err = png.Decode(file)
-	case "":
+	config, err := p.checkPixelBudget(file, mimeType)
+	if err != nil {
+		slog.Warn("Refusing to decode image", "path", path, "err", err)
+		return nil, image.Point{}, nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, image.Point{}, nil, err
+	}
+	sourceSize = image.Pt(config.Width, config.Height)
+
+	scale, denominator := 1.0, 1
+	if mimeType == MIMEImageJpeg {
+		scale = hint.scale(config.Width, config.Height)
+		denominator = scaleDenominator(scale)
+	}
+
+	estimate := decodeMemoryEstimate(config, denominator, hint)
+	span.SetAttributes(
+		attribute.Int("image.source_width", config.Width),
+		attribute.Int("image.source_height", config.Height),
+		attribute.Int("decode.scale_denominator", denominator),
+		attribute.Int64("decode.memory_bytes", estimate),
+	)
+
+	release, err = p.memoryBudget.Acquire(ctx, estimate)
+	if err != nil {
+		slog.Warn("Could not reserve memory to decode image", "path", path, "bytes", estimate, "err", err)
+		return nil, image.Point{}, nil, err
+	}
+	span.AddEvent("memory reserved")
+
+	start := time.Now()
+	reader := contextReader{ctx: ctx, r: file}
+	switch {
+	case denominator > 1:
+		img, err = decodeScaledJpeg(ctx, file, config, scale)
+	case mimeType == MIMEImageJpeg:
+		img, err = jpeg.Decode(reader)
+	case mimeType == MIMEImagePng:
+		img, err = png.Decode(reader)
+	default:
 		err = fmt.Errorf("Unknown image type")
 	}
 
+	// The scaling decoder does not support every kind of JPEG, image/jpeg reads the rest at full size
+	if err != nil && denominator > 1 && !isContextError(err) {
+		slog.Warn("Scaled decode failed, decoding at full size", "path", path, "err", err)
+		span.AddEvent("scaled decode failed", trace.WithAttributes(attribute.String("error", err.Error())))
+		release()
+
+		estimate = decodeMemoryEstimate(config, 1, hint)
+		release, err = p.memoryBudget.Acquire(ctx, estimate)
+		if err != nil {
+			slog.Warn("Could not reserve memory to decode image", "path", path, "bytes", estimate, "err", err)
+			return nil, image.Point{}, nil, err
+		}
+
+		if _, err = file.Seek(0, io.SeekStart); err == nil {
+			img, err = jpeg.Decode(reader)
+		}
+	}
+
 	if err != nil {
+		release()
+		return nil, image.Point{}, nil, err
+	}
+
+	decodeDuration.Observe(time.Since(start).Seconds())
+	return img, sourceSize, release, nil
+}
+
+// decodeScaledJpeg decodes file at no less than scale times its full size, using the EXIF thumbnail when it is big enough
+func decodeScaledJpeg(ctx context.Context, file *os.File, config image.Config, scale float64) (image.Image, error) {
+	if exif, err := readExif(file); err == nil && exif.thumbnail != nil {
+		if img := decodeThumbnail(exif.thumbnail, config, scale); img != nil {
+			slog.Debug("Decoded exif thumbnail", "path", file.Name(), "width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+			return img, nil
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
 
-	return img, nil
+	denominator := scaleDenominator(scale)
+	slog.Debug("Decoding scaled jpeg", "path", file.Name(), "scale", fmt.Sprintf("1/%d", denominator))
+	return jpegn.Decode(contextReader{ctx: ctx, r: file}, &jpegn.Options{ScaleDenom: denominator})
 }
 
-func (p *ImageStorageDisk) ImageWithTransform(key string, settings ImageSettings) (image.Image, error) {
+// decodeThumbnail decodes an EXIF thumbnail if it has the aspect ratio of the full image and is at least
+// scale times its size. It returns nil otherwise.
+func decodeThumbnail(thumbnail []byte, config image.Config, scale float64) image.Image {
+	thumbnailConfig, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		return nil
+	}
+
+	if float64(thumbnailConfig.Width) < math.Ceil(scale*float64(config.Width)) ||
+		float64(thumbnailConfig.Height) < math.Ceil(scale*float64(config.Height)) {
+		return nil
+	}
 
-	img, err := p.Image(key)
+	// Cameras often pad thumbnails to a fixed 4:3 or 16:9 box. Those can not stand in for the full image.
+	aspect := float64(config.Width) / float64(config.Height)
+	thumbnailAspect := float64(thumbnailConfig.Width) / float64(thumbnailConfig.Height)
+	if math.Abs(aspect-thumbnailAspect) > aspect*thumbnailAspectTolerance {
+		return nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(thumbnail))
 	if err != nil {
-		return nil, err
+		return nil
 	}
+	return img
+}
+
+// scaleDenominator returns the largest JPEG IDCT scaling denominator that still decodes at least scale of the image
+func scaleDenominator(scale float64) int {
+	for _, denominator := range []int{8, 4, 2} {
+		if 1/float64(denominator) >= scale {
+			return denominator
+		}
+	}
+	return 1
+}
 
+// ImageWithTransform decodes and transforms the image on a worker of the transform pool.
+// It returns the error of the pool when no worker is available. The memory reserved for the
+// image is released when it returns, as the store can not tell when the caller is done with it.
+func (p *ImageStorageDisk) ImageWithTransform(ctx context.Context, key string, settings ImageSettings) (image.Image, error) {
+	var img image.Image
+	err := p.transformPool.Do(ctx, func() error {
+		transformed, release, err := p.transform(ctx, key, settings)
+		if err != nil {
+			return err
+		}
+		release()
+		img = transformed
+		return nil
+	})
+	return img, err
+}
+
+// transform decodes the image stored under key and applies settings to it. Call release once the
+// transformed image and anything made from it, such as its encoded bytes, are no longer needed.
+func (p *ImageStorageDisk) transform(ctx context.Context, key string, settings ImageSettings) (img image.Image, release func(), err error) {
+
+	img, sourceSize, release, err := p.decode(ctx, key, settings.sizeHint())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// An image scaled down while decoding may already have the requested size, but still needs automatic sharpening
 	bounds := img.Bounds()
-	if bounds.Dx() == settings.Width && bounds.Dy() == settings.Height && !settings.Grayscale && settings.Blur == 0 {
-		return img, nil
+	scaled := bounds.Size() != sourceSize
+	if bounds.Dx() == settings.Width && bounds.Dy() == settings.Height && !settings.hasAdjustments() && !(scaled && settings.AutoSharpen) {
+		return img, release, nil
+	}
+
+	start := time.Now()
+	_, span := tracer.Start(ctx, "transform", trace.WithAttributes(settingsAttributes(key, settings)...))
+	img, err = p.imageTransformer.Transform(ctx, img, sourceSize, settings)
+	endSpan(span, err)
+	if err != nil {
+		release()
+		return nil, nil, err
 	}
 
-	return p.imageTransformer.Transform(img, settings)
+	transformDuration.Observe(time.Since(start).Seconds())
+	return img, release, nil
 }
 
 func (p *ImageStorageDisk) LoadImages() error {
@@ -147,12 +476,21 @@ func (p *ImageStorageDisk) LoadImages() error {
 		if err != nil {
 			return err
 		}
-		_, filename := filepath.Split(path)
+		if info.IsDir() && p.quarantineDir != "" && path == p.quarantineDir {
+			return filepath.SkipDir
+		}
 		if !info.IsDir() {
 
-			fileExt := filepath.Ext(filename)
-			if supportedImageFile(fileExt) {
-				p.images.Insert(filename)
+			fileExt := filepath.Ext(path)
+			if supportedImageFile(fileExt) && p.acceptImage(path) {
+				// Images in subdirectories are keyed by their path relative to the store, e.g. 2023/beach.jpg
+				key, err := filepath.Rel(p.location, path)
+				if err != nil {
+					return err
+				}
+				p.mu.Lock()
+				p.images.Insert(filepath.ToSlash(key))
+				p.mu.Unlock()
 			}
 		}
 		return nil
@@ -162,11 +500,83 @@ func (p *ImageStorageDisk) LoadImages() error {
 		return fmt.Errorf("failed to load images: %v", err)
 	}
 
-	slog.Info("Loaded images", "directory", p.location, "count", p.images.Size())
+	slog.Info("Loaded images", "directory", p.location, "count", p.ImageCount())
 
 	return err
 }
 
+// acceptImage reports whether the image at path can be served. Images that cannot be read or that are
+// over the pixel budget are skipped, and moved to the quarantine directory when one is configured.
+func (p *ImageStorageDisk) acceptImage(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		slog.Warn("Skipping unreadable image", "path", path, "err", err)
+		return false
+	}
+
+	config, err := p.checkPixelBudget(file, p.MimeType(path))
+	file.Close()
+
+	if err == nil {
+		return true
+	}
+
+	if err != errImageTooLarge {
+		slog.Warn("Skipping invalid image", "path", path, "err", err)
+		return false
+	}
+
+	slog.Warn("Skipping image over the pixel budget", "path", path,
+		"width", config.Width, "height", config.Height, "maxPixels", p.maxPixels)
+
+	if p.quarantineDir != "" {
+		if target, err := p.quarantine(path); err != nil {
+			slog.Error("Failed to quarantine image", "path", path, "target", target, "err", err)
+		} else {
+			slog.Info("Quarantined image", "path", path, "target", target)
+		}
+	}
+
+	return false
+}
+
+// quarantine moves the image at path to the same path relative to the quarantine directory, so images with
+// the same name in different subdirectories stay apart. An image already in quarantine is never replaced.
+func (p *ImageStorageDisk) quarantine(path string) (string, error) {
+	rel, err := filepath.Rel(p.location, path)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(p.quarantineDir, rel)
+	if _, err := os.Lstat(target); err == nil {
+		return target, os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return target, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return target, err
+	}
+
+	return target, os.Rename(path, target)
+}
+
+// checkPixelBudget reads the header of an image encoded as mimeType from r and returns errImageTooLarge
+// if decoding the image would exceed the pixel budget
+func (p *ImageStorageDisk) checkPixelBudget(r io.Reader, mimeType string) (image.Config, error) {
+	config, err := decodeConfig(r, mimeType)
+	if err != nil {
+		return config, err
+	}
+
+	if p.maxPixels > 0 && int64(config.Width)*int64(config.Height) > int64(p.maxPixels) {
+		return config, errImageTooLarge
+	}
+
+	return config, nil
+}
+
 func supportedImageFile(fileExt string) bool {
 	fileExt = strings.ToLower(fileExt)
 	switch fileExt {
@@ -0,0 +1,445 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJpeg returns a width x height JPEG with a pattern that has detail to sharpen
+func testJpeg(t testing.TB, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8((x / 8 % 2) * 255), A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeTestFile writes data to path, creating its directory if needed
+func writeTestFile(t testing.TB, path string, data []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestJpeg writes a width x height JPEG to path, creating its directory if needed
+func writeTestJpeg(t testing.TB, path string, width, height int) {
+	t.Helper()
+	writeTestFile(t, path, testJpeg(t, width, height))
+}
+
+// newTestStorage loads the images in dir into a disk store without limits
+func newTestStorage(t testing.TB, dir string) *ImageStorageDisk {
+	t.Helper()
+
+	transformer, err := NewImageTransfomer(ServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewImageStorage(ImageStoreTypeLocal, transformer, dir, 0, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage.(*ImageStorageDisk)
+}
+
+func TestImageStorageDiskSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 40, 30)
+	writeTestJpeg(t, filepath.Join(dir, "2023", "beach.jpg"), 30, 40)
+	writeTestJpeg(t, filepath.Join(dir, "2024", "beach.jpg"), 20, 20)
+
+	storage := newTestStorage(t, dir)
+
+	keys := storage.Keys()
+	slices.Sort(keys)
+	if want := []string{"2023/beach.jpg", "2024/beach.jpg", "a.jpg"}; !slices.Equal(keys, want) {
+		t.Fatalf("Keys() = %v, want %v", keys, want)
+	}
+
+	tests := []struct {
+		key           string
+		folder        string
+		width, height int
+		caption       string
+	}{
+		{"a.jpg", filepath.Base(dir), 40, 30, filepath.Base(dir) + ": a, a.jpg"},
+		{"2023/beach.jpg", "2023", 30, 40, "2023: beach, beach.jpg"},
+		{"2024/beach.jpg", "2024", 20, 20, "2024: beach, beach.jpg"},
+	}
+
+	for _, test := range tests {
+		info, err := storage.Info(test.key)
+		if err != nil {
+			t.Fatalf("Info(%q) error = %v", test.key, err)
+		}
+		if info.Folder != test.folder || info.Width != test.width || info.Height != test.height {
+			t.Errorf("Info(%q) = folder %q, %dx%d, want folder %q, %dx%d", test.key,
+				info.Folder, info.Width, info.Height, test.folder, test.width, test.height)
+		}
+
+		if caption := expandCaption("{folder}: {name}, {filename}", info); caption != test.caption {
+			t.Errorf("expandCaption() = %q, want %q", caption, test.caption)
+		}
+	}
+}
+
+func TestScaleDenominator(t *testing.T) {
+	tests := []struct {
+		scale float64
+		want  int
+	}{
+		{0.05, 8},
+		{0.125, 8},
+		{0.13, 4},
+		{0.25, 4},
+		{0.3, 2},
+		{0.5, 2},
+		{0.51, 1},
+		{1, 1},
+		{2, 1},
+	}
+
+	for _, test := range tests {
+		if got := scaleDenominator(test.scale); got != test.want {
+			t.Errorf("scaleDenominator(%g) = %d, want %d", test.scale, got, test.want)
+		}
+	}
+}
+
+func TestDecodeThumbnail(t *testing.T) {
+	config := image.Config{Width: 1600, Height: 1200}
+
+	tests := []struct {
+		name          string
+		width, height int
+		scale         float64
+		want          bool
+	}{
+		{"large enough", 160, 120, 0.1, true},
+		{"larger than needed", 320, 240, 0.1, true},
+		{"too small", 160, 120, 0.2, false},
+		{"padded to 16:9", 160, 90, 0.05, false},
+		{"padded to a square", 160, 160, 0.05, false},
+		{"rounding within tolerance", 161, 120, 0.1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := decodeThumbnail(testJpeg(t, test.width, test.height), config, test.scale)
+			if got := img != nil; got != test.want {
+				t.Fatalf("decodeThumbnail() used the thumbnail = %t, want %t", got, test.want)
+			}
+			if img != nil && (img.Bounds().Dx() != test.width || img.Bounds().Dy() != test.height) {
+				t.Errorf("decodeThumbnail() = %v, want %dx%d", img.Bounds(), test.width, test.height)
+			}
+		})
+	}
+
+	if img := decodeThumbnail([]byte("not a jpeg"), config, 0.1); img != nil {
+		t.Errorf("decodeThumbnail() decoded an invalid thumbnail")
+	}
+}
+
+func TestDecodeScaled(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 1600, 1200)
+	storage := newTestStorage(t, dir)
+
+	img, sourceSize, release, err := storage.decode(context.Background(), "a.jpg", sizeHint{Width: 400, Height: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if img.Bounds().Dx() != 400 || img.Bounds().Dy() != 300 {
+		t.Errorf("decode() = %v, want 400x300", img.Bounds())
+	}
+	if sourceSize != image.Pt(1600, 1200) {
+		t.Errorf("decode() sourceSize = %v, want 1600x1200", sourceSize)
+	}
+}
+
+// An extended sequential (SOF1) JPEG can be read by image/jpeg but not by the scaling decoder
+func TestDecodeScaledFallback(t *testing.T) {
+	data := testJpeg(t, 800, 600)
+	sof := bytes.Index(data, []byte{0xFF, 0xC0})
+	if sof < 0 {
+		t.Fatal("no SOF0 marker in test image")
+	}
+	data[sof+1] = 0xC1
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "extended.jpg"), data)
+	storage := newTestStorage(t, dir)
+
+	img, _, release, err := storage.decode(context.Background(), "extended.jpg", sizeHint{Width: 100, Height: 75})
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	release()
+
+	if img.Bounds().Dx() != 800 || img.Bounds().Dy() != 600 {
+		t.Errorf("decode() = %v, want the full 800x600", img.Bounds())
+	}
+}
+
+// Automatic sharpening must measure the downscale from the stored image, not from the scaled decode
+func TestAutoSharpenAfterScaledDecode(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 1600, 1200)
+	storage := newTestStorage(t, dir)
+
+	settings := ImageSettings{Width: 400, Height: 300, ResizeMode: "fit", Filter: FilterCatmullRom}
+	plain, err := storage.ImageDataWithTransform(context.Background(), "a.jpg", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings.AutoSharpen = true
+	sharpened, err := storage.ImageDataWithTransform(context.Background(), "a.jpg", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(plain, sharpened) {
+		t.Errorf("sharpen=auto returned the same image as no sharpening")
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	dir := b.TempDir()
+	writeTestJpeg(b, filepath.Join(dir, "a.jpg"), 4000, 3000)
+	storage := newTestStorage(b, dir)
+
+	benchmarks := []struct {
+		name string
+		hint sizeHint
+	}{
+		{"full", sizeHint{}},
+		{"scaled 1/2", sizeHint{Width: 2000, Height: 1500}},
+		{"scaled 1/4", sizeHint{Width: 1000, Height: 750}},
+		{"scaled 1/8", sizeHint{Width: 400, Height: 300}},
+	}
+
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			for b.Loop() {
+				_, _, release, err := storage.decode(context.Background(), "a.jpg", benchmark.hint)
+				if err != nil {
+					b.Fatal(err)
+				}
+				release()
+			}
+		})
+	}
+}
+
+// Run with -race. Every method of the store is called concurrently, and afterwards every key must still have its file.
+func TestImageStorageDiskConcurrentUse(t *testing.T) {
+	const (
+		goroutines = 4
+		iterations = 50
+	)
+
+	dir := t.TempDir()
+	storage := newTestStorage(t, dir)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	data := testJpeg(t, 16, 16)
+
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Go(func() {
+			for i := range iterations {
+				// Adds fail when a concurrent Clear removes their temporary file, which is expected
+				storage.Add(fmt.Sprintf("add-%d-%d.png", g, i%5), MIMEImagePng, img)
+			}
+		})
+		wg.Go(func() {
+			for i := range iterations {
+				storage.AddData(fmt.Sprintf("data-%d-%d.jpeg", g, i%5), data)
+			}
+		})
+		wg.Go(func() {
+			for i := range iterations {
+				storage.Contains(fmt.Sprintf("data-%d-%d.jpeg", g, i%5))
+				storage.ImageCount()
+				storage.Empty()
+			}
+		})
+		wg.Go(func() {
+			for range iterations {
+				for key := range storage.Images() {
+					storage.MimeType(key)
+				}
+				storage.Keys()
+			}
+		})
+	}
+	wg.Go(func() {
+		for range iterations / 5 {
+			if err := storage.Clear(); err != nil {
+				t.Errorf("Clear() error = %v", err)
+			}
+		}
+	})
+	wg.Wait()
+
+	for _, key := range storage.Keys() {
+		if _, err := os.Stat(filepath.Join(dir, key)); err != nil {
+			t.Errorf("key %q has no file: %v", key, err)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".tmp" {
+			t.Errorf("temporary file %q was left behind", file.Name())
+		}
+	}
+}
+
+var errTransformFailed = errors.New("transform failed")
+
+type failingTransformer struct{}
+
+func (failingTransformer) Transform(context.Context, image.Image, image.Point, ImageSettings) (image.Image, error) {
+	return nil, errTransformFailed
+}
+
+// The reservation of a transform is held until its image is encoded, and released afterwards
+func TestImageDataWithTransformReleasesMemory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	storage := newTestStorage(t, dir)
+	storage.memoryBudget = NewMemoryBudget(1<<30, time.Second)
+
+	settings := ImageSettings{Width: 200, Height: 150, ResizeMode: "fit", Grayscale: true}
+	if _, err := storage.ImageDataWithTransform(context.Background(), "a.jpg", settings); err != nil {
+		t.Fatal(err)
+	}
+	if used := storage.memoryBudget.Used(); used != 0 {
+		t.Errorf("Used() after ImageDataWithTransform = %d, want 0", used)
+	}
+
+	storage.imageTransformer = failingTransformer{}
+	if _, err := storage.ImageDataWithTransform(context.Background(), "a.jpg", settings); err != errTransformFailed {
+		t.Fatalf("ImageDataWithTransform() error = %v, want %v", err, errTransformFailed)
+	}
+	if used := storage.memoryBudget.Used(); used != 0 {
+		t.Errorf("Used() after a failed transform = %d, want 0", used)
+	}
+}
+
+// testPngHeader returns the start of a PNG that claims to be width x height, enough for decodeConfig
+func testPngHeader(t testing.TB, width, height uint32) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// The IHDR chunk follows the 8 byte signature: length, type, width, height, ..., CRC of type and data
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data[:33]
+}
+
+func TestCheckPixelBudget(t *testing.T) {
+	storage := &ImageStorageDisk{maxPixels: 16 * 1024 * 1024}
+
+	tests := []struct {
+		name          string
+		width, height uint32
+		want          error
+	}{
+		{"within the budget", 4096, 4096, nil},
+		{"over the budget", 4097, 4096, errImageTooLarge},
+		{"product overflows 32 bits", 65535, 65535, errImageTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := testPngHeader(t, test.width, test.height)
+			if _, err := storage.checkPixelBudget(bytes.NewReader(data), MIMEImagePng); err != test.want {
+				t.Errorf("checkPixelBudget() error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, quarantineDir := t.TempDir(), t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "small.jpg"), 10, 10)
+	writeTestJpeg(t, filepath.Join(dir, "a", "big.jpg"), 40, 30)
+	writeTestJpeg(t, filepath.Join(dir, "b", "big.jpg"), 30, 40)
+	writeTestJpeg(t, filepath.Join(dir, "c", "big.jpg"), 40, 40)
+
+	// Left by an earlier run, must not be replaced
+	earlier := testJpeg(t, 20, 20)
+	writeTestFile(t, filepath.Join(quarantineDir, "c", "big.jpg"), earlier)
+
+	transformer, err := NewImageTransfomer(ServiceSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewImageStorage(ImageStoreTypeLocal, transformer, dir, 500, quarantineDir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := storage.Keys(); !slices.Equal(keys, []string{"small.jpg"}) {
+		t.Errorf("Keys() = %v, want only the image within the budget", keys)
+	}
+
+	for _, key := range []string{"a/big.jpg", "b/big.jpg"} {
+		if _, err := os.Stat(filepath.Join(quarantineDir, key)); err != nil {
+			t.Errorf("%s was not quarantined: %v", key, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, key)); !os.IsNotExist(err) {
+			t.Errorf("%s was left in the image directory", key)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(quarantineDir, "c", "big.jpg")); err != nil || !bytes.Equal(data, earlier) {
+		t.Errorf("an image already in quarantine was replaced")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c", "big.jpg")); err != nil {
+		t.Errorf("an image that could not be quarantined was removed: %v", err)
+	}
+}
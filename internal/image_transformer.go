@@ -1,43 +1,218 @@
 package internal
 
 import (
+	"context"
 	"image"
 	"log/slog"
+	"math"
 
 	"github.com/nao1215/imaging"
 )
 
 type ImageTransformerInterface interface {
-	Transform(img image.Image, imageSettings ImageSettings) (image.Image, error)
+	// Transform applies imageSettings to img. sourceSize is the size of the stored image, which is larger
+	// than img when it was scaled down while decoding. A zero sourceSize stands for the size of img.
+	Transform(ctx context.Context, img image.Image, sourceSize image.Point, imageSettings ImageSettings) (image.Image, error)
 }
 
 type ImageTransformer struct {
+	settings  ServiceSettings
+	watermark *watermark
 }
 
-func NewImageTransfomer() *ImageTransformer {
-	return &ImageTransformer{}
+func NewImageTransfomer(settings ServiceSettings) (*ImageTransformer, error) {
+	watermark, err := loadWatermark(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageTransformer{
+		settings:  settings,
+		watermark: watermark,
+	}, nil
 }
 
-func (t *ImageTransformer) Transform(img image.Image, imageSettings ImageSettings) (image.Image, error) {
-	slog.Debug("settings", "width", imageSettings.Width, "height", imageSettings.Height, "grayscale", imageSettings.Grayscale, "blur", imageSettings.Blur, "resizeMode", imageSettings.ResizeMode)
+// Transform applies the settings to img in the following order:
+//
+//  1. Rotate (clockwise) and flip, so the requested size applies to the rotated image
+//  2. Resize, fill, fit or pad
+//  3. Sharpen, or automatic sharpening based on how much the image was downscaled
+//  4. Brightness, contrast, saturation, hue and gamma
+//  5. Grayscale, sepia and duotone
+//  6. Blur
+//  7. Pixelate
+//  8. Vignette
+//  9. Border
+//  10. Caption
+//  11. Watermark
+//  12. Rounded corners or circle mask
+//
+// Transform returns the error of ctx if it is done between steps.
+func (t *ImageTransformer) Transform(ctx context.Context, img image.Image, sourceSize image.Point, imageSettings ImageSettings) (image.Image, error) {
+	slog.Debug("settings", "width", imageSettings.Width, "height", imageSettings.Height, "grayscale", imageSettings.Grayscale, "blur", imageSettings.Blur, "resizeMode", imageSettings.ResizeMode, "gravity", imageSettings.Gravity, "rotate", imageSettings.Rotate, "flip", imageSettings.Flip,
+		"brightness", imageSettings.Brightness, "contrast", imageSettings.Contrast, "saturation", imageSettings.Saturation,
+		"hue", imageSettings.Hue, "gamma", imageSettings.Gamma,
+		"sepia", imageSettings.Sepia, "duotone", imageSettings.Duotone, "pixelate", imageSettings.Pixelate, "vignette", imageSettings.Vignette,
+		"sharpen", imageSettings.Sharpen, "autoSharpen", imageSettings.AutoSharpen, "filter", imageSettings.Filter, "watermark", imageSettings.Watermark, "text", imageSettings.Text,
+		"padBackground", imageSettings.PadBackground, "padBlur", imageSettings.PadBlur,
+		"borderWidth", imageSettings.BorderWidth, "borderColor", imageSettings.BorderColor,
+		"radius", imageSettings.Radius, "mask", imageSettings.Mask)
+
+	switch imageSettings.Rotate {
+	case 90:
+		img = imaging.Rotate270(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+
+	switch imageSettings.Flip {
+	case FlipHorizontal:
+		img = imaging.FlipH(img)
+	case FlipVertical:
+		img = imaging.FlipV(img)
+	}
+
+	// How much the image is downscaled is measured against the stored image, in the orientation of img
+	sourceWidth, sourceHeight := sourceSize.X, sourceSize.Y
+	if sourceWidth <= 0 || sourceHeight <= 0 {
+		sourceWidth, sourceHeight = img.Bounds().Dx(), img.Bounds().Dy()
+	} else if imageSettings.Rotate == 90 || imageSettings.Rotate == 270 {
+		sourceWidth, sourceHeight = sourceHeight, sourceWidth
+	}
 
+	filter := resampleFilter(imageSettings.Filter)
 	if imageSettings.Height == 0 {
-		img = imaging.Resize(img, imageSettings.Width, imageSettings.Height, imaging.CatmullRom)
+		img = imaging.Resize(img, imageSettings.Width, imageSettings.Height, filter)
+	} else if imageSettings.ResizeMode == "fill" && imageSettings.Gravity == GravitySmart {
+		img = imaging.Crop(img, smartCropRect(img, imageSettings.Width, imageSettings.Height, t.settings.SmartCropSkinTone))
+		img = imaging.Resize(img, imageSettings.Width, imageSettings.Height, filter)
 	} else if imageSettings.ResizeMode == "fill" {
-		img = imaging.Fill(img, imageSettings.Width, imageSettings.Height, imaging.Center, imaging.CatmullRom)
+		img = imaging.Fill(img, imageSettings.Width, imageSettings.Height, imaging.Center, filter)
+	} else if imageSettings.ResizeMode == "pad" {
+		img = pad(img, imageSettings.Width, imageSettings.Height, imageSettings.PadBackground, imageSettings.PadBlur, filter)
 	} else if imageSettings.ResizeMode == "fit" {
-		img = imaging.Fit(img, imageSettings.Width, imageSettings.Height, imaging.CatmullRom)
+		img = imaging.Fit(img, imageSettings.Width, imageSettings.Height, filter)
 	} else {
-		img = imaging.Resize(img, imageSettings.Width, imageSettings.Height, imaging.CatmullRom)
+		img = imaging.Resize(img, imageSettings.Width, imageSettings.Height, filter)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if imageSettings.Sharpen > 0 {
+		img = imaging.Sharpen(img, imageSettings.Sharpen)
+	} else if imageSettings.AutoSharpen {
+		scaleFactor := math.Max(
+			float64(sourceWidth)/float64(img.Bounds().Dx()),
+			float64(sourceHeight)/float64(img.Bounds().Dy()),
+		)
+		if amount := autoSharpenAmount(scaleFactor); amount > 0 {
+			img = unsharpMask(img, autoSharpenSigma, amount)
+		}
+	}
+
+	if imageSettings.Brightness != 0 {
+		img = imaging.AdjustBrightness(img, imageSettings.Brightness)
+	}
+
+	if imageSettings.Contrast != 0 {
+		img = imaging.AdjustContrast(img, imageSettings.Contrast)
+	}
+
+	if imageSettings.Saturation != 0 {
+		img = imaging.AdjustSaturation(img, imageSettings.Saturation)
+	}
+
+	if imageSettings.Hue != 0 {
+		img = imaging.AdjustHue(img, imageSettings.Hue)
+	}
+
+	if imageSettings.hasGamma() {
+		img = imaging.AdjustGamma(img, imageSettings.Gamma)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	if imageSettings.Grayscale {
 		img = imaging.Grayscale(img)
 	}
 
+	if imageSettings.Sepia {
+		img = sepia(img)
+	}
+
+	if len(imageSettings.Duotone) == 2 {
+		img = duotone(img, imageSettings.Duotone[0], imageSettings.Duotone[1])
+	}
+
 	if imageSettings.Blur > 0 {
 		img = imaging.Blur(img, imageSettings.Blur)
 	}
 
+	if imageSettings.Pixelate > 1 {
+		img = pixelate(img, imageSettings.Pixelate)
+	}
+
+	if imageSettings.Vignette > 0 {
+		img = vignette(img, imageSettings.Vignette)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if imageSettings.BorderWidth > 0 {
+		img = border(img, imageSettings.BorderWidth, imageSettings.BorderColor)
+	}
+
+	if imageSettings.Text != "" {
+		captioned, err := drawCaption(img, imageSettings.Text, imageSettings.TextSize, imageSettings.TextColor, imageSettings.TextBackground, imageSettings.TextPosition)
+		if err != nil {
+			return nil, err
+		}
+		img = captioned
+	}
+
+	if imageSettings.Watermark && t.watermark != nil {
+		img = t.watermark.apply(img)
+	}
+
+	if imageSettings.Mask == MaskCircle {
+		img = circleMask(img)
+	} else if imageSettings.Radius > 0 {
+		img = roundCorners(img, imageSettings.Radius)
+	}
+
 	return img, nil
 }
+
+// IsResampleFilter reports whether name is a supported resampling filter
+func IsResampleFilter(name string) bool {
+	switch name {
+	case FilterLanczos, FilterCatmullRom, FilterLinear, FilterBox, FilterNearest:
+		return true
+	default:
+		return false
+	}
+}
+
+// resampleFilter returns the imaging filter for name, falling back to Catmull-Rom
+func resampleFilter(name string) imaging.ResampleFilter {
+	switch name {
+	case FilterLanczos:
+		return imaging.Lanczos
+	case FilterLinear:
+		return imaging.Linear
+	case FilterBox:
+		return imaging.Box
+	case FilterNearest:
+		return imaging.NearestNeighbor
+	default:
+		return imaging.CatmullRom
+	}
+}
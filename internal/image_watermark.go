@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"math"
+	"os"
+
+	"github.com/nao1215/imaging"
+)
+
+// watermark composites a branding image onto a corner of the transformed image
+type watermark struct {
+	image    image.Image
+	position string
+	margin   int
+	scale    float64
+	opacity  float64
+}
+
+// loadWatermark reads the PNG configured in settings. It returns nil when no watermark is configured.
+func loadWatermark(settings ServiceSettings) (*watermark, error) {
+	if settings.WatermarkFile == "" {
+		return nil, nil
+	}
+
+	switch settings.WatermarkPosition {
+	case WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight:
+	default:
+		return nil, fmt.Errorf("invalid watermark position: %s", settings.WatermarkPosition)
+	}
+
+	if settings.WatermarkMargin < 0 {
+		return nil, fmt.Errorf("watermark margin cannot be negative: %d", settings.WatermarkMargin)
+	}
+
+	if !(settings.WatermarkScale > 0 && settings.WatermarkScale <= 1) {
+		return nil, fmt.Errorf("watermark scale must be greater than 0 and at most 1: %g", settings.WatermarkScale)
+	}
+
+	if !(settings.WatermarkOpacity >= 0 && settings.WatermarkOpacity <= 1) {
+		return nil, fmt.Errorf("watermark opacity must be between 0 and 1: %g", settings.WatermarkOpacity)
+	}
+
+	file, err := os.Open(settings.WatermarkFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark %s: %v", settings.WatermarkFile, err)
+	}
+
+	slog.Info("Loaded watermark", "file", settings.WatermarkFile, "width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+
+	return &watermark{
+		image:    img,
+		position: settings.WatermarkPosition,
+		margin:   settings.WatermarkMargin,
+		scale:    settings.WatermarkScale,
+		opacity:  settings.WatermarkOpacity,
+	}, nil
+}
+
+// apply scales the watermark relative to the width of img and draws it in the configured corner
+func (w *watermark) apply(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	width := max(1, int(math.Round(float64(bounds.Dx())*w.scale)))
+	mark := imaging.Resize(w.image, width, 0, imaging.Lanczos)
+	markSize := mark.Bounds().Size()
+
+	x := bounds.Min.X + w.margin
+	if w.position == WatermarkTopRight || w.position == WatermarkBottomRight {
+		x = bounds.Max.X - w.margin - markSize.X
+	}
+
+	y := bounds.Min.Y + w.margin
+	if w.position == WatermarkBottomLeft || w.position == WatermarkBottomRight {
+		y = bounds.Max.Y - w.margin - markSize.Y
+	}
+
+	return imaging.Overlay(img, mark, image.Pt(x, y), w.opacity)
+}
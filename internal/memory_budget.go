@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"image"
+	"sync"
+	"time"
+)
+
+// bytesPerPixel is the memory taken by a decoded pixel. Transforms work on 8 bit RGBA images.
+const bytesPerPixel = 4
+
+// ErrMemoryTimeout is returned when a decode waited longer than the timeout for memory to be released
+var ErrMemoryTimeout = errors.New("timed out waiting for decode memory")
+
+// MemoryBudget limits how much memory the images being decoded and transformed may take at the same time.
+// A reservation larger than the whole budget is only granted while nothing else is reserved, so every
+// image can still be served, one at a time.
+type MemoryBudget struct {
+	mu       sync.Mutex
+	limit    int64
+	used     int64
+	released chan struct{} // Closed and replaced every time memory is released
+	timeout  time.Duration
+}
+
+// NewMemoryBudget creates a budget of limit bytes. Reservations wait up to timeout for memory to
+// become available. A limit of 0 disables the budget.
+func NewMemoryBudget(limit int64, timeout time.Duration) *MemoryBudget {
+	return &MemoryBudget{
+		limit:    limit,
+		released: make(chan struct{}),
+		timeout:  timeout,
+	}
+}
+
+// Acquire reserves n bytes, waiting for other reservations to be released if needed. It returns
+// ErrMemoryTimeout when the memory did not become available within the timeout, and the error of ctx
+// when it is done first. The returned function releases the reservation and must be called exactly once.
+func (m *MemoryBudget) Acquire(ctx context.Context, n int64) (func(), error) {
+	if m == nil || m.limit <= 0 {
+		return func() {}, nil
+	}
+
+	var timer *time.Timer
+	for {
+		m.mu.Lock()
+		if m.used == 0 || m.used+n <= m.limit {
+			m.used += n
+			m.mu.Unlock()
+			return func() { m.release(n) }, nil
+		}
+		released := m.released
+		m.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(m.timeout)
+			defer timer.Stop()
+		}
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return nil, ErrMemoryTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *MemoryBudget) release(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= n
+	close(m.released)
+	m.released = make(chan struct{})
+}
+
+// Used returns the number of bytes currently reserved
+func (m *MemoryBudget) Used() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used
+}
+
+// Limit returns the size of the budget in bytes, 0 when it is disabled
+func (m *MemoryBudget) Limit() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.limit
+}
+
+// decodeMemoryEstimate returns the bytes needed to decode the image described by config at 1/denominator of its
+// size and to produce the output described by hint from it
+func decodeMemoryEstimate(config image.Config, denominator int, hint sizeHint) int64 {
+	decodedWidth := (config.Width + denominator - 1) / denominator
+	decodedHeight := (config.Height + denominator - 1) / denominator
+	pixels := int64(decodedWidth) * int64(decodedHeight)
+
+	outputWidth, outputHeight := hint.Width, hint.Height
+	if config.Width > 0 && config.Height > 0 {
+		if outputHeight <= 0 {
+			outputHeight = outputWidth * config.Height / config.Width
+		} else if outputWidth <= 0 {
+			outputWidth = outputHeight * config.Width / config.Height
+		}
+	}
+	pixels += int64(max(0, outputWidth)) * int64(max(0, outputHeight))
+
+	return pixels * bytesPerPixel
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetAcquire(t *testing.T) {
+	budget := NewMemoryBudget(100, time.Second)
+
+	release, err := budget.Acquire(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Used() != 60 {
+		t.Errorf("Used() = %d, want 60", budget.Used())
+	}
+
+	releaseMore, err := budget.Acquire(context.Background(), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Used() != 100 {
+		t.Errorf("Used() = %d, want 100", budget.Used())
+	}
+
+	release()
+	releaseMore()
+	if budget.Used() != 0 {
+		t.Errorf("Used() after release = %d, want 0", budget.Used())
+	}
+}
+
+func TestMemoryBudgetOversizedWhenIdle(t *testing.T) {
+	budget := NewMemoryBudget(100, 50*time.Millisecond)
+
+	release, err := budget.Acquire(context.Background(), 500)
+	if err != nil {
+		t.Fatalf("Acquire() of more than the limit on an idle budget: %v", err)
+	}
+	if budget.Used() != 500 {
+		t.Errorf("Used() = %d, want 500", budget.Used())
+	}
+
+	// Nothing else fits while the oversized reservation is held
+	if _, err := budget.Acquire(context.Background(), 1); err != ErrMemoryTimeout {
+		t.Errorf("Acquire() while oversized is held: error = %v, want %v", err, ErrMemoryTimeout)
+	}
+	release()
+
+	// And an oversized reservation waits for the others to be released
+	releaseSmall, err := budget.Acquire(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := budget.Acquire(context.Background(), 500); err != ErrMemoryTimeout {
+		t.Errorf("Acquire() of more than the limit on a busy budget: error = %v, want %v", err, ErrMemoryTimeout)
+	}
+	releaseSmall()
+}
+
+func TestMemoryBudgetTimeout(t *testing.T) {
+	budget := NewMemoryBudget(100, 50*time.Millisecond)
+
+	release, err := budget.Acquire(context.Background(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	start := time.Now()
+	if _, err := budget.Acquire(context.Background(), 30); err != ErrMemoryTimeout {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrMemoryTimeout)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Acquire() gave up after %v, before the timeout", waited)
+	}
+	if budget.Used() != 80 {
+		t.Errorf("Used() after a timeout = %d, want 80", budget.Used())
+	}
+}
+
+func TestMemoryBudgetContextCanceled(t *testing.T) {
+	budget := NewMemoryBudget(100, time.Minute)
+
+	release, err := budget.Acquire(context.Background(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := budget.Acquire(ctx, 30); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire() error = %v, want %v", err, context.Canceled)
+	}
+	if budget.Used() != 80 {
+		t.Errorf("Used() after a cancel = %d, want 80", budget.Used())
+	}
+}
+
+func TestMemoryBudgetWaitsForRelease(t *testing.T) {
+	budget := NewMemoryBudget(100, time.Minute)
+
+	release, err := budget.Acquire(context.Background(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, release)
+
+	releaseWaiting, err := budget.Acquire(context.Background(), 30)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	releaseWaiting()
+}
+
+func TestMemoryBudgetDisabled(t *testing.T) {
+	for _, budget := range []*MemoryBudget{nil, NewMemoryBudget(0, 0)} {
+		release, err := budget.Acquire(context.Background(), 1<<40)
+		if err != nil {
+			t.Fatalf("Acquire() on a disabled budget: %v", err)
+		}
+		release()
+		if budget.Used() != 0 || budget.Limit() != 0 {
+			t.Errorf("disabled budget reports Used() = %d, Limit() = %d", budget.Used(), budget.Limit())
+		}
+	}
+}
+
+func TestDecodeMemoryEstimate(t *testing.T) {
+	config := image.Config{Width: 4000, Height: 3000}
+
+	tests := []struct {
+		name        string
+		denominator int
+		hint        sizeHint
+		want        int64
+	}{
+		{"full size", 1, sizeHint{}, 4000 * 3000 * bytesPerPixel},
+		{"scaled with output", 4, sizeHint{Width: 800, Height: 600}, (1000*750 + 800*600) * bytesPerPixel},
+		{"width only", 8, sizeHint{Width: 400}, (500*375 + 400*300) * bytesPerPixel},
+		{"rounds up", 8, sizeHint{}, 500 * 375 * bytesPerPixel},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := decodeMemoryEstimate(config, test.denominator, test.hint); got != test.want {
+				t.Errorf("decodeMemoryEstimate() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
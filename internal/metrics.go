@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "imgserve"
+
+// metricsRegistry holds every metric exposed on /metrics. A registry of our own keeps
+// metrics registered by dependencies on the default registry out.
+var metricsRegistry = prometheus.NewRegistry()
+
+// durationBuckets go from 5ms to about 20s, which covers serving a cached thumbnail up to transforming a large photo on a Pi
+var durationBuckets = prometheus.ExponentialBuckets(0.005, 2, 13)
+
+var (
+	requestsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to answer HTTP requests by route, method and status.",
+		Buckets:   durationBuckets,
+	}, []string{"route", "method", "status"})
+
+	bytesServed = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_response_bytes_total",
+		Help:      "Number of response body bytes sent by route.",
+	}, []string{"route"})
+
+	decodeDuration = promauto.With(metricsRegistry).NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "decode_duration_seconds",
+		Help:      "Time taken to decode source images. Cached images are sent without decoding.",
+		Buckets:   durationBuckets,
+	})
+
+	transformDuration = promauto.With(metricsRegistry).NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "transform_duration_seconds",
+		Help:      "Time taken to transform decoded images.",
+		Buckets:   durationBuckets,
+	})
+
+	cacheHits = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of requests served from the cache.",
+	})
+
+	cacheMisses = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_misses_total",
+		Help:      "Number of requests that were not in the cache.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// RegisterServiceMetrics exposes the number of loaded images, the state of the transform pool and the
+// memory reserved for decoding as gauges. It must be called once, after storage has loaded its images.
+func RegisterServiceMetrics(storage ImageStorageInterface, pool *TransformPool, budget *MemoryBudget) {
+	metricsRegistry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "images_loaded",
+			Help:      "Number of images that can be served.",
+		}, func() float64 { return float64(storage.ImageCount()) }),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "transform_queue_depth",
+			Help:      "Number of requests waiting for a transform worker.",
+		}, func() float64 { return float64(pool.QueueDepth()) }),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "transform_workers_active",
+			Help:      "Number of transform workers busy with a request.",
+		}, func() float64 { return float64(pool.Active()) }),
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "decode_memory_reserved_bytes",
+			Help:      "Memory reserved by images being decoded and transformed.",
+		}, func() float64 { return float64(budget.Used()) }),
+	)
+}
+
+// MetricsMiddleware counts requests, their duration and the bytes sent, labeled by the route pattern
+// so that ids and sizes in the path do not create a series each
+func MetricsMiddleware(c fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+
+	route := c.Route().Path
+	if status == fiber.StatusNotFound && route == "/" {
+		route = "unmatched"
+	}
+
+	labels := prometheus.Labels{"route": route, "method": c.Method(), "status": strconv.Itoa(status)}
+	requestsTotal.With(labels).Inc()
+	requestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+	if c.Method() != fiber.MethodHead {
+		bytesServed.WithLabelValues(route).Add(float64(len(c.Response().Body())))
+	}
+
+	return err
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func MetricsHandler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
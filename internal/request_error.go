@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// statusClientClosedRequest is the status logged for requests abandoned because the client went away.
+// The client never sees it.
+const statusClientClosedRequest = 499
+
+// RequestError is sent to the client as a JSON body when a request cannot be served
+type RequestError struct {
+	Status    int    `json:"status"`
+	Message   string `json:"error"`
+	Parameter string `json:"parameter,omitempty"`
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// invalidParameter returns a 400 error for the named request parameter
+func invalidParameter(parameter string, format string, args ...any) *RequestError {
+	return &RequestError{
+		Status:    fiber.StatusBadRequest,
+		Message:   fmt.Sprintf(format, args...),
+		Parameter: parameter,
+	}
+}
+
+// serverError returns a 500 error that does not relate to any request parameter
+func serverError(message string) *RequestError {
+	return &RequestError{
+		Status:  fiber.StatusInternalServerError,
+		Message: message,
+	}
+}
+
+// sendError writes err to the response as JSON
+func sendError(c fiber.Ctx, err *RequestError) error {
+	return c.Status(err.Status).JSON(err)
+}
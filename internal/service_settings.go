@@ -1,11 +1,87 @@
 package internal
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
 // ServiceSettings holds configuration parameters for the service
 type ServiceSettings struct {
-	ImageDir    string // Path to the directory where photos are stored
-	CertFile    string // Path to SSL/TLS certificate file
-	CertKeyFile string // Path to SSL/TLS certificate private key file
-	LogLevel    string // Logging verbosity level (e.g. debug, info, warn, error)
-	Port        string // Port to listen on
-	CacheDir    string // Path to the directory where temporary files are stored
+	ImageDir    string  // Path to the directory where photos are stored
+	CertFile    string  // Path to SSL/TLS certificate file
+	CertKeyFile string  // Path to SSL/TLS certificate private key file
+	LogLevel    string  // Logging verbosity level (e.g. debug, info, warn, error)
+	Port        string  // Port to listen on
+	CacheDir    string  // Path to the directory where temporary files are stored
+	MaxWidth    int     // Largest width in pixels an image can be returned with
+	MaxHeight   int     // Largest height in pixels an image can be returned with
+	MaxPixels   int     // Largest number of pixels an image can be returned with, 0 for no limit
+	MaxBlur     float64 // Largest blur sigma a request can ask for
+	MaxUpscale  float64 // Largest factor a source image can be enlarged by, 0 for no limit
+
+	MaxSourcePixels int    // Largest source image, in pixels, that will be decoded. 0 for no limit
+	QuarantineDir   string // Directory to move source images over MaxSourcePixels to, empty to leave them in place
+
+	Workers      int           // Number of images decoded and transformed at the same time
+	QueueSize    int           // Number of requests that can wait for a worker before new ones are rejected
+	QueueTimeout time.Duration // How long a request waits for a worker before it is rejected
+
+	RequestTimeout time.Duration // How long a request may take to decode, transform and encode its image, 0 for no limit
+
+	MaxDecodeMemory int64 // Memory in MiB that images being decoded and transformed may take at the same time, 0 for no limit
+
+	RandomCacheControl string // Cache-Control header of random images, empty to send none
+	StableCacheControl string // Cache-Control header of images requested by id or seed, empty to send none
+
+	OtlpEndpoint string // URL of the OTLP/HTTP collector traces are exported to, empty to disable tracing
+
+	SmartCropSkinTone bool   // Favor skin tones when picking a smart crop window
+	AutoSharpen       bool   // Sharpen downscaled images unless the request sets sharpen
+	ResizeFilter      string // Resampling filter used when the request does not set one
+
+	WatermarkFile     string  // Path to a PNG composited onto every image, empty to disable
+	WatermarkPosition string  // Corner to place the watermark in (topleft, topright, bottomleft, bottomright)
+	WatermarkMargin   int     // Distance in pixels between the watermark and the edges of the image
+	WatermarkScale    float64 // Width of the watermark relative to the width of the image
+	WatermarkOpacity  float64 // Opacity of the watermark from 0 to 1
+
+	CaptionTemplate   string  // Caption drawn on every image unless the request sets text, e.g. "{date} — {folder}"
+	CaptionSize       float64 // Default caption font size in pixels
+	CaptionColor      string  // Default caption text color as hex
+	CaptionBackground string  // Default caption background band color as hex, including alpha
+	CaptionPosition   string  // Default caption position (top, bottom)
+}
+
+// outputFingerprint hashes the settings that change served images without being part of the request,
+// including the content of the watermark file. It is part of the ETag and cache key of every image,
+// so clients and the cache get new images when any of them changes.
+func (s ServiceSettings) outputFingerprint() (string, error) {
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "skin:%t_filter:%s_wm:%s_wp:%s_wmg:%d_ws:%f_wo:%f",
+		s.SmartCropSkinTone,
+		s.ResizeFilter,
+		s.WatermarkFile,
+		s.WatermarkPosition,
+		s.WatermarkMargin,
+		s.WatermarkScale,
+		s.WatermarkOpacity,
+	)
+
+	if s.WatermarkFile != "" {
+		file, err := os.Open(s.WatermarkFile)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(hasher, file); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))[:16], nil
 }
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gofiber/fiber/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracingServiceName = "imgserve"
+
+// tracer creates the spans of the service. Until SetupTracing is called it comes from
+// the global no-op provider, so tracing costs next to nothing when it is disabled.
+var tracer = otel.Tracer("picserve/internal")
+
+// SetupTracing exports spans over OTLP/HTTP to endpoint, a URL such as http://localhost:4318.
+// Incoming W3C trace context headers are honored, so spans join the trace of the caller.
+// The returned function flushes the remaining spans and must be called before the process exits.
+func SetupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracingServiceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = provider.Tracer("picserve/internal")
+
+	return provider.Shutdown, nil
+}
+
+// startRequestSpan starts the server span of the request, continuing the trace of the caller if it sent
+// one. Call the returned function when the response is ready to record its status and end the span.
+func startRequestSpan(c fiber.Ctx, name string) (context.Context, func()) {
+	parent := otel.GetTextMapPropagator().Extract(c.Context(), headerCarrier{c})
+	ctx, span := tracer.Start(parent, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", c.Method()),
+			attribute.String("http.route", c.Route().Path),
+		))
+
+	return ctx, func() {
+		status := c.Response().StatusCode()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// settingsAttributes describes the image and the transformation applied to it
+func settingsAttributes(imageKey string, settings ImageSettings) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("image.key", imageKey),
+		attribute.Int("image.width", settings.Width),
+		attribute.Int("image.height", settings.Height),
+		attribute.String("image.resize_mode", settings.ResizeMode),
+		attribute.String("image.mime_type", settings.mimeType()),
+		attribute.String("image.settings", settings.cacheKey(imageKey)),
+	}
+}
+
+// headerCarrier lets the propagator read the trace context from the request headers
+type headerCarrier struct {
+	c fiber.Ctx
+}
+
+func (h headerCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	h.c.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h.c.GetReqHeaders()))
+	for key := range h.c.GetReqHeaders() {
+		keys = append(keys, key)
+	}
+	return keys
+}
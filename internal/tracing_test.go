@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans sends the spans of the service to an in-memory exporter until the test ends
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	previousTracer, previousPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("picserve/internal")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = previousTracer
+		otel.SetTextMapPropagator(previousPropagator)
+		provider.Shutdown(t.Context())
+	})
+
+	return exporter
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// childSpans returns the spans directly under parent by name
+func childSpans(spans tracetest.SpanStubs, parent tracetest.SpanStub) map[string]tracetest.SpanStub {
+	children := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		if span.Parent.SpanID() == parent.SpanContext.SpanID() {
+			children[span.Name] = span
+		}
+	}
+	return children
+}
+
+func requestSpan(t *testing.T, spans tracetest.SpanStubs) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == "HandleRequest" {
+			return span
+		}
+	}
+	t.Fatalf("no HandleRequest span in %d spans", len(spans))
+	return tracetest.SpanStub{}
+}
+
+func TestRequestSpans(t *testing.T) {
+	exporter := recordSpans(t)
+
+	dir := t.TempDir()
+	writeTestJpeg(t, filepath.Join(dir, "a.jpg"), 400, 300)
+	cache := newTestCache(t, dir, NewTransformPool(1, 1, 0))
+	app := newTestApp(newTestHandler(t, testServiceSettings(), cache))
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	response := testRequest(t, app, "/id/a.jpg/200/150?grayscale=true", http.Header{"Traceparent": {traceparent}})
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("GET = %d, want 200", response.StatusCode)
+	}
+
+	spans := exporter.GetSpans()
+	root := requestSpan(t, spans)
+
+	if root.SpanKind != trace.SpanKindServer {
+		t.Errorf("HandleRequest kind = %v, want server", root.SpanKind)
+	}
+	if got := root.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("HandleRequest trace = %s, want the trace of the traceparent header", got)
+	}
+	if got := root.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("HandleRequest parent = %s, want the span of the traceparent header", got)
+	}
+
+	children := childSpans(spans, root)
+	for _, name := range []string{"pickImage", "cache.lookup", "decode", "transform", "encode"} {
+		if _, ok := children[name]; !ok {
+			t.Errorf("no %s span under HandleRequest", name)
+		}
+	}
+
+	// The request span and the transform span describe the image and its settings
+	for _, span := range []tracetest.SpanStub{root, children["transform"]} {
+		if key, _ := spanAttribute(span, "image.key"); key.AsString() != "a.jpg" {
+			t.Errorf("%s image.key = %q, want a.jpg", span.Name, key.AsString())
+		}
+		if settings, _ := spanAttribute(span, "image.settings"); !strings.HasPrefix(settings.AsString(), "n:a.jpg_w:200_h:150_") {
+			t.Errorf("%s image.settings = %q, want the settings of the request", span.Name, settings.AsString())
+		}
+	}
+
+	if status, _ := spanAttribute(root, "http.response.status_code"); status.AsInt64() != fiber.StatusOK {
+		t.Errorf("http.response.status_code = %d, want 200", status.AsInt64())
+	}
+	if hit, ok := spanAttribute(children["cache.lookup"], "cache.hit"); !ok || hit.AsBool() {
+		t.Errorf("cache.hit of the first request = %v, want false", hit.AsBool())
+	}
+	if key, _ := spanAttribute(children["pickImage"], "image.key"); key.AsString() != "a.jpg" {
+		t.Errorf("pickImage image.key = %q, want a.jpg", key.AsString())
+	}
+
+	// The same request again is served from the cache without decoding
+	exporter.Reset()
+	testRequest(t, app, "/id/a.jpg/200/150?grayscale=true", nil)
+
+	spans = exporter.GetSpans()
+	children = childSpans(spans, requestSpan(t, spans))
+	if hit, _ := spanAttribute(children["cache.lookup"], "cache.hit"); !hit.AsBool() {
+		t.Errorf("cache.hit of the second request = false, want true")
+	}
+	for _, name := range []string{"decode", "transform", "encode"} {
+		if _, ok := children[name]; ok {
+			t.Errorf("cache hit has a %s span", name)
+		}
+	}
+}
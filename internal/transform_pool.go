@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when every worker is busy and the queue has no room left
+	ErrQueueFull = errors.New("transform queue is full")
+
+	// ErrQueueTimeout is returned when a job waited in the queue longer than the queue timeout
+	ErrQueueTimeout = errors.New("timed out waiting for a transform worker")
+)
+
+// TransformPool limits how many images are decoded and transformed at the same time.
+// Jobs beyond the number of workers wait in a bounded queue for up to the queue timeout.
+type TransformPool struct {
+	workers chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func NewTransformPool(workers int, queueSize int, timeout time.Duration) *TransformPool {
+	return &TransformPool{
+		workers: make(chan struct{}, max(1, workers)),
+		queue:   make(chan struct{}, max(0, queueSize)),
+		timeout: timeout,
+	}
+}
+
+// Do runs job once a worker is free. It returns ErrQueueFull without running job when the
+// queue is full, ErrQueueTimeout when no worker became free within the queue timeout, and
+// the error of ctx when it is done before a worker became free. A nil pool runs job right away.
+func (t *TransformPool) Do(ctx context.Context, job func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if t == nil {
+		return job()
+	}
+
+	select {
+	case t.workers <- struct{}{}:
+		return t.run(job)
+	default:
+	}
+
+	select {
+	case t.queue <- struct{}{}:
+	default:
+		return ErrQueueFull
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	select {
+	case t.workers <- struct{}{}:
+		<-t.queue
+		return t.run(job)
+	case <-timer.C:
+		<-t.queue
+		return ErrQueueTimeout
+	case <-ctx.Done():
+		<-t.queue
+		return ctx.Err()
+	}
+}
+
+func (t *TransformPool) run(job func() error) error {
+	defer func() { <-t.workers }()
+	return job()
+}
+
+// QueueDepth returns the number of jobs waiting for a worker
+func (t *TransformPool) QueueDepth() int {
+	return len(t.queue)
+}
+
+// QueueSize returns the number of jobs that can wait for a worker
+func (t *TransformPool) QueueSize() int {
+	return cap(t.queue)
+}
+
+// Active returns the number of jobs currently running
+func (t *TransformPool) Active() int {
+	return len(t.workers)
+}
+
+// Workers returns the number of jobs that can run at the same time
+func (t *TransformPool) Workers() int {
+	return cap(t.workers)
+}
+
+// RetryAfter returns how long clients should wait before retrying a rejected job
+func (t *TransformPool) RetryAfter() time.Duration {
+	return max(time.Second, t.timeout)
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// occupy keeps every worker of pool busy until the returned function is first called
+func occupy(t testing.TB, pool *TransformPool) func() {
+	t.Helper()
+
+	done := make(chan struct{})
+	for range pool.Workers() {
+		started := make(chan struct{})
+		go pool.Do(context.Background(), func() error {
+			close(started)
+			<-done
+			return nil
+		})
+		<-started
+	}
+	return sync.OnceFunc(func() { close(done) })
+}
+
+// waitForQueue waits until depth jobs are waiting for a worker of pool
+func waitForQueue(t testing.TB, pool *TransformPool, depth int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.QueueDepth() < depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("QueueDepth() = %d, want %d", pool.QueueDepth(), depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTransformPoolRunsJob(t *testing.T) {
+	pool := NewTransformPool(2, 1, time.Second)
+
+	errJob := errors.New("job failed")
+	ran := false
+	err := pool.Do(context.Background(), func() error {
+		ran = true
+		if pool.Active() != 1 {
+			t.Errorf("Active() while running = %d, want 1", pool.Active())
+		}
+		return errJob
+	})
+	if !ran || err != errJob {
+		t.Errorf("Do() ran = %t, error = %v, want the job run and its error", ran, err)
+	}
+	if pool.Active() != 0 {
+		t.Errorf("Active() after the job = %d, want 0", pool.Active())
+	}
+}
+
+func TestTransformPoolQueueFull(t *testing.T) {
+	pool := NewTransformPool(1, 1, time.Minute)
+	release := occupy(t, pool)
+	defer release()
+
+	queued := make(chan error, 1)
+	go func() { queued <- pool.Do(context.Background(), func() error { return nil }) }()
+	waitForQueue(t, pool, 1)
+
+	if err := pool.Do(context.Background(), func() error {
+		t.Error("job ran with the queue full")
+		return nil
+	}); err != ErrQueueFull {
+		t.Errorf("Do() error = %v, want %v", err, ErrQueueFull)
+	}
+
+	// The queued job runs once the worker is free
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued Do() error = %v", err)
+	}
+}
+
+func TestTransformPoolQueueTimeout(t *testing.T) {
+	pool := NewTransformPool(1, 1, 50*time.Millisecond)
+	defer occupy(t, pool)()
+
+	start := time.Now()
+	if err := pool.Do(context.Background(), func() error {
+		t.Error("job ran without a free worker")
+		return nil
+	}); err != ErrQueueTimeout {
+		t.Fatalf("Do() error = %v, want %v", err, ErrQueueTimeout)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Do() gave up after %v, before the queue timeout", waited)
+	}
+	if pool.QueueDepth() != 0 {
+		t.Errorf("QueueDepth() after a timeout = %d, want 0", pool.QueueDepth())
+	}
+}
+
+func TestTransformPoolCanceledWhileQueued(t *testing.T) {
+	pool := NewTransformPool(1, 1, time.Minute)
+	defer occupy(t, pool)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan error, 1)
+	go func() {
+		queued <- pool.Do(ctx, func() error {
+			t.Error("canceled job ran")
+			return nil
+		})
+	}()
+	waitForQueue(t, pool, 1)
+	cancel()
+
+	if err := <-queued; !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() error = %v, want %v", err, context.Canceled)
+	}
+	if pool.QueueDepth() != 0 {
+		t.Errorf("QueueDepth() after a cancel = %d, want 0", pool.QueueDepth())
+	}
+}
+
+func TestTransformPoolDoneContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, pool := range []*TransformPool{nil, NewTransformPool(1, 1, time.Second)} {
+		if err := pool.Do(ctx, func() error {
+			t.Error("job ran with a done context")
+			return nil
+		}); !errors.Is(err, context.Canceled) {
+			t.Errorf("Do() error = %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+func TestTransformPoolNil(t *testing.T) {
+	var pool *TransformPool
+
+	ran := false
+	if err := pool.Do(context.Background(), func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("Do() on a nil pool ran = %t, error = %v, want the job run", ran, err)
+	}
+}
+
+func TestTransformPoolRetryAfter(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{100 * time.Millisecond, time.Second},
+		{10 * time.Second, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := NewTransformPool(1, 1, test.timeout).RetryAfter(); got != test.want {
+			t.Errorf("RetryAfter() with a timeout of %v = %v, want %v", test.timeout, got, test.want)
+		}
+	}
+}
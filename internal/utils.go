@@ -1,5 +1,19 @@
 package internal
 
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
 func fileExtFromMimeType(mimeType string) string {
 	switch mimeType {
 	case MIMEImageJpeg:
@@ -10,3 +24,91 @@ func fileExtFromMimeType(mimeType string) string {
 		return ""
 	}
 }
+
+// decodeConfig reads the header of an image encoded as mimeType. image.DecodeConfig is avoided because the
+// scaling JPEG decoder registers itself for JPEGs, and it rejects some files image/jpeg can read.
+func decodeConfig(r io.Reader, mimeType string) (image.Config, error) {
+	switch mimeType {
+	case MIMEImageJpeg:
+		return jpeg.DecodeConfig(r)
+	case MIMEImagePng:
+		return png.DecodeConfig(r)
+	default:
+		return image.Config{}, fmt.Errorf("unsupported image format: %s", mimeType)
+	}
+}
+
+// encodeImage encodes img as mimeType. Encoding stops with the error of ctx once it is done.
+func encodeImage(ctx context.Context, img image.Image, mimeType string) ([]byte, error) {
+	var buf bytes.Buffer
+	out := contextWriter{ctx: ctx, w: &buf}
+
+	var err error
+	switch mimeType {
+	case MIMEImageJpeg:
+		err = jpeg.Encode(out, img, nil)
+	case MIMEImagePng:
+		err = png.Encode(out, img)
+	default:
+		err = fmt.Errorf("unsupported image format: %s", mimeType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func clampInt(value, low, high int) int {
+	return max(low, min(value, high))
+}
+
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func absInt64(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func clampUint8(value float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, value))))
+}
+
+// parseHexColor parses colors in the form RRGGBB, RRGGBBAA or RGB with an optional leading #
+func parseHexColor(value string) (color.NRGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) == 3 {
+		value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+	if len(value) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", value)
+	}
+
+	rgba, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", value)
+	}
+
+	return color.NRGBA{
+		R: uint8(rgba >> 24),
+		G: uint8(rgba >> 16),
+		B: uint8(rgba >> 8),
+		A: uint8(rgba),
+	}, nil
+}
+
+// IsHexColor reports whether value can be parsed as a hex color
+func IsHexColor(value string) bool {
+	_, err := parseHexColor(value)
+	return err == nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"picserve/internal"
+	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/recover"
@@ -22,6 +27,34 @@ func init() {
 	flag.StringVar(&settings.LogLevel, "logLevel", "INFO", "Path to the certificate key file")
 	flag.StringVar(&settings.Port, "port", "8080", "The port to listen on")
 	flag.StringVar(&settings.CacheDir, "cacheDir", "", "The directory to store temporary files")
+	flag.IntVar(&settings.MaxWidth, "maxWidth", 4096, "Largest width in pixels an image can be returned with")
+	flag.IntVar(&settings.MaxHeight, "maxHeight", 4096, "Largest height in pixels an image can be returned with")
+	flag.IntVar(&settings.MaxPixels, "maxPixels", 16*1024*1024, "Largest number of pixels an image can be returned with, 0 for no limit")
+	flag.Float64Var(&settings.MaxBlur, "maxBlur", 50, "Largest blur sigma a request can ask for")
+	flag.Float64Var(&settings.MaxUpscale, "maxUpscale", 4, "Largest factor a source image can be enlarged by, 0 for no limit")
+	flag.IntVar(&settings.MaxSourcePixels, "maxSourcePixels", 50_000_000, "Largest source image, in pixels, that will be decoded. 0 for no limit")
+	flag.StringVar(&settings.QuarantineDir, "quarantineDir", "", "Directory to move source images over maxSourcePixels to")
+	flag.IntVar(&settings.Workers, "workers", runtime.NumCPU(), "Number of images decoded and transformed at the same time")
+	flag.IntVar(&settings.QueueSize, "queueSize", 4*runtime.NumCPU(), "Number of requests that can wait for a worker before new ones are rejected")
+	flag.DurationVar(&settings.QueueTimeout, "queueTimeout", 10*time.Second, "How long a request waits for a worker before it is rejected")
+	flag.Int64Var(&settings.MaxDecodeMemory, "maxDecodeMemory", 512, "Memory in MiB that images being decoded and transformed may take at the same time, 0 for no limit")
+	flag.DurationVar(&settings.RequestTimeout, "requestTimeout", 30*time.Second, "How long a request may take to be processed, including the queue, 0 for no limit")
+	flag.StringVar(&settings.RandomCacheControl, "randomCacheControl", "no-store", "Cache-Control header of random images, empty to send none")
+	flag.StringVar(&settings.StableCacheControl, "stableCacheControl", "public, max-age=31536000, immutable", "Cache-Control header of images requested by id or seed, empty to send none")
+	flag.StringVar(&settings.OtlpEndpoint, "otlpEndpoint", "", "URL of an OTLP/HTTP collector to export traces to, e.g. http://localhost:4318. Empty to disable tracing")
+	flag.BoolVar(&settings.SmartCropSkinTone, "smartCropSkinTone", false, "Favor skin tones when picking a smart crop window")
+	flag.BoolVar(&settings.AutoSharpen, "autoSharpen", false, "Sharpen downscaled images unless the request sets sharpen")
+	flag.StringVar(&settings.ResizeFilter, "resizeFilter", internal.FilterCatmullRom, "Default resampling filter (lanczos, catmullrom, linear, box, nearest)")
+	flag.StringVar(&settings.WatermarkFile, "watermark", "", "Path to a PNG watermark to composite onto images")
+	flag.StringVar(&settings.WatermarkPosition, "watermarkPosition", internal.WatermarkBottomRight, "Corner to place the watermark in (topleft, topright, bottomleft, bottomright)")
+	flag.IntVar(&settings.WatermarkMargin, "watermarkMargin", 16, "Distance in pixels between the watermark and the edges of the image")
+	flag.Float64Var(&settings.WatermarkScale, "watermarkScale", 0.2, "Width of the watermark relative to the width of the image")
+	flag.Float64Var(&settings.WatermarkOpacity, "watermarkOpacity", 0.5, "Opacity of the watermark from 0 to 1")
+	flag.StringVar(&settings.CaptionTemplate, "caption", "", "Caption drawn on every image, supports {date}, {folder}, {filename} and {name}")
+	flag.Float64Var(&settings.CaptionSize, "captionSize", 24, "Default caption font size in pixels")
+	flag.StringVar(&settings.CaptionColor, "captionColor", "ffffff", "Default caption text color as hex")
+	flag.StringVar(&settings.CaptionBackground, "captionBackground", "00000080", "Default caption background color as hex, including alpha")
+	flag.StringVar(&settings.CaptionPosition, "captionPosition", internal.CaptionBottom, "Default caption position (top, bottom)")
 }
 
 func setLogLevel() error {
@@ -44,30 +77,84 @@ func resolvePath(path string) (string, error) {
 	return imageDir, nil
 }
 
-func checkFlags() (imageDir string, cacheDir string, err error) {
+func checkFlags() (imageDir string, cacheDir string, quarantineDir string, err error) {
 	imageDir, err = resolvePath(settings.ImageDir)
 	if err != nil {
 		slog.Error("Failed to resolve image directory", "error", err)
-		return "", "", err
+		return "", "", "", err
 	}
 
 	if settings.CacheDir != "" {
 		cacheDir, err = resolvePath(settings.CacheDir)
 		if err != nil {
 			slog.Error("Failed to resolve cache directory", "error", err)
-			return "", "", err
+			return "", "", "", err
 		}
 	} else {
 		slog.Info("Cache directory not set. Caching is DISABLED.")
 		cacheDir = ""
 	}
 
+	if settings.MaxWidth < 1 || settings.MaxHeight < 1 || settings.MaxPixels < 0 || settings.MaxBlur < 0 || settings.MaxUpscale < 0 {
+		slog.Error("Invalid output limits", "maxWidth", settings.MaxWidth, "maxHeight", settings.MaxHeight,
+			"maxPixels", settings.MaxPixels, "maxBlur", settings.MaxBlur, "maxUpscale", settings.MaxUpscale)
+		return "", "", "", fmt.Errorf("invalid output limits")
+	}
+
+	if settings.Workers < 1 || settings.QueueSize < 0 || settings.QueueTimeout < 0 {
+		slog.Error("Invalid transform pool settings", "workers", settings.Workers, "queueSize", settings.QueueSize, "queueTimeout", settings.QueueTimeout)
+		return "", "", "", fmt.Errorf("invalid transform pool settings")
+	}
+
+	if settings.MaxDecodeMemory < 0 {
+		slog.Error("Invalid decode memory budget", "maxDecodeMemory", settings.MaxDecodeMemory)
+		return "", "", "", fmt.Errorf("invalid decode memory budget")
+	}
+
+	if settings.RequestTimeout < 0 {
+		slog.Error("Invalid request timeout", "requestTimeout", settings.RequestTimeout)
+		return "", "", "", fmt.Errorf("invalid request timeout")
+	}
+
+	if !internal.IsResampleFilter(settings.ResizeFilter) {
+		slog.Error("Invalid resize filter", "filter", settings.ResizeFilter)
+		return "", "", "", fmt.Errorf("invalid resize filter: %s", settings.ResizeFilter)
+	}
+
+	if !internal.IsHexColor(settings.CaptionColor) || !internal.IsHexColor(settings.CaptionBackground) {
+		slog.Error("Invalid caption color", "color", settings.CaptionColor, "background", settings.CaptionBackground)
+		return "", "", "", fmt.Errorf("invalid caption color")
+	}
+
+	if settings.CaptionPosition != internal.CaptionTop && settings.CaptionPosition != internal.CaptionBottom {
+		slog.Error("Invalid caption position", "position", settings.CaptionPosition)
+		return "", "", "", fmt.Errorf("invalid caption position: %s", settings.CaptionPosition)
+	}
+
 	if imageDir == cacheDir {
 		slog.Error("Image directory and cache directory cannot be the same")
-		return "", "", fmt.Errorf("image directory and cache directory cannot be the same")
+		return "", "", "", fmt.Errorf("image directory and cache directory cannot be the same")
 	}
 
-	return imageDir, cacheDir, nil
+	if settings.QuarantineDir != "" {
+		quarantineDir, err = resolvePath(settings.QuarantineDir)
+		if err != nil {
+			slog.Error("Failed to resolve quarantine directory", "error", err)
+			return "", "", "", err
+		}
+
+		if quarantineDir == imageDir || quarantineDir == cacheDir {
+			slog.Error("Quarantine directory must be different from the image and cache directories")
+			return "", "", "", fmt.Errorf("quarantine directory must be different from the image and cache directories")
+		}
+
+		if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+			slog.Error("Failed to create quarantine directory", "error", err)
+			return "", "", "", err
+		}
+	}
+
+	return imageDir, cacheDir, quarantineDir, nil
 }
 
 func main() {
@@ -78,19 +165,38 @@ func main() {
 
 	setLogLevel()
 
-	imageDir, cacheDir, err := checkFlags()
+	imageDir, cacheDir, quarantineDir, err := checkFlags()
 	if err != nil {
 		os.Exit(1)
 	}
 
-	imageTransformer := internal.NewImageTransfomer()
-	imageStorage, err := internal.NewImageStorage(internal.ImageStoreTypeLocal, imageTransformer, imageDir)
+	shutdownTracing := func(context.Context) error { return nil }
+	if settings.OtlpEndpoint != "" {
+		shutdownTracing, err = internal.SetupTracing(context.Background(), settings.OtlpEndpoint)
+		if err != nil {
+			log.Fatalf("Error setting up tracing: %v", err)
+		}
+		slog.Info("Exporting traces", "endpoint", settings.OtlpEndpoint)
+	}
+
+	imageTransformer, err := internal.NewImageTransfomer(settings)
+	if err != nil {
+		log.Fatalf("Error creating image transformer: %v", err)
+	}
+
+	// Only the image store decodes while serving requests, cached images are sent as they are stored
+	memoryBudget := internal.NewMemoryBudget(settings.MaxDecodeMemory*1024*1024, settings.QueueTimeout)
+
+	// Transforms run on the pool, cached images are read without waiting for a worker
+	transformPool := internal.NewTransformPool(settings.Workers, settings.QueueSize, settings.QueueTimeout)
+
+	imageStorage, err := internal.NewImageStorage(internal.ImageStoreTypeLocal, imageTransformer, imageDir, settings.MaxSourcePixels, quarantineDir, memoryBudget, transformPool)
 	if err != nil {
 		log.Fatalf("Error creating image storage: %v", err)
 	}
 
 	if cacheDir != "" {
-		imageCacheStorage, err := internal.NewImageStorage(internal.ImageStoreTypeLocal, imageTransformer, cacheDir)
+		imageCacheStorage, err := internal.NewImageStorage(internal.ImageStoreTypeLocal, imageTransformer, cacheDir, settings.MaxSourcePixels, "", nil, nil)
 		imageCache, err = internal.NewImageCacheLocal(imageStorage, imageCacheStorage)
 		if err != nil {
 			log.Fatalf("Error creating image storage: %v", err)
@@ -101,15 +207,45 @@ func main() {
 	}
 
 	imagePicker := internal.NewRandomImagePicker(imageStorage)
-	imageHandler := internal.NewImageHandler(settings, imageCache, imagePicker)
+	imageHandler, err := internal.NewImageHandler(settings, imageCache, imagePicker, transformPool)
+	if err != nil {
+		log.Fatalf("Error creating image handler: %v", err)
+	}
 
 	app := fiber.New()
+	// Metrics come first so requests that panic are counted with the status recover answers them with
+	app.Use(internal.MetricsMiddleware)
 	app.Use(recover.New())
 
-	app.Get("/:width<int>", imageHandler.HandleRequest)
-	app.Get("/:width<int>/:height<int>", imageHandler.HandleRequest)
+	internal.RegisterServiceMetrics(imageStorage, transformPool, memoryBudget)
+	app.Get("/metrics", internal.MetricsHandler())
+
+	healthHandler := internal.NewHealthHandler(imageDir, cacheDir, imageStorage)
+	app.Get("/healthz", healthHandler.HandleHealth)
+	app.Get("/readyz", healthHandler.HandleReady)
+
+	imageMethods := []string{fiber.MethodGet, fiber.MethodHead}
+	app.Add(imageMethods, "/:width<int>", imageHandler.HandleRequest)
+	app.Add(imageMethods, "/:width<int>/:height<int>", imageHandler.HandleRequest)
+	app.Add(imageMethods, "/id/:id/:width<int>", imageHandler.HandleRequest)
+	app.Add(imageMethods, "/id/:id/:width<int>/:height<int>", imageHandler.HandleRequest)
+	app.Add(imageMethods, "/seed/:seed/:width<int>", imageHandler.HandleRequest)
+	app.Add(imageMethods, "/seed/:seed/:width<int>/:height<int>", imageHandler.HandleRequest)
+
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	listeningPort := fmt.Sprintf(":%s", settings.Port)
 	slog.Info("Starting server", "port", listeningPort)
-	log.Fatal(app.Listen(listeningPort, fiber.ListenConfig{CertFile: settings.CertFile, CertKeyFile: settings.CertKeyFile}))
+	err = app.Listen(listeningPort, fiber.ListenConfig{CertFile: settings.CertFile, CertKeyFile: settings.CertKeyFile, GracefulContext: stopped})
+
+	// Export the spans of the last requests before exiting
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Server stopped")
 }